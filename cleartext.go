@@ -0,0 +1,284 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CleartextMode is how a Transport starts a session to an http:// URL,
+// where there is no TLS to negotiate SPDY with.
+type CleartextMode int
+
+const (
+	// PriorKnowledge speaks SPDY from the first byte, trusting that the
+	// server does too.
+	PriorKnowledge CleartextMode = iota
+
+	// Upgrade first asks the server to switch from HTTP/1.1 to spdy/3
+	// with an Upgrade handshake.
+	Upgrade
+)
+
+func (m CleartextMode) String() string {
+	switch m {
+	case PriorKnowledge:
+		return "PriorKnowledge"
+	case Upgrade:
+		return "Upgrade"
+	}
+	return fmt.Sprintf("CleartextMode(%d)", int(m))
+}
+
+// isControlWord reports whether b begins with the first word of a SPDY/3
+// control frame, which is how every session starts. The control bit is
+// never set in the first byte of an HTTP/1.1 request.
+func isControlWord(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x80 != 0 && (uint16(b[0])<<8|uint16(b[1]))&0x7fff == Version
+}
+
+// ServeCleartext accepts connections on l and serves each of them as a SPDY
+// session without TLS. A client may start speaking SPDY straight away, with
+// prior knowledge, or first send an HTTP/1.1 request asking to upgrade to
+// spdy/3. Other HTTP/1.1 requests are answered with 426 Upgrade Required.
+func (srv *Server) ServeCleartext(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.serveCleartextConn(c)
+	}
+}
+
+func (srv *Server) serveCleartextConn(c net.Conn) error {
+	// Bound the sniff and any upgrade handshake, so that a client that
+	// sends nothing does not hold the connection open for ever.
+	c.SetDeadline(time.Now().Add(sniffTimeout))
+	br := bufio.NewReader(c)
+	first, err := br.Peek(2)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if !isControlWord(first) {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			c.Close()
+			return err
+		}
+		if !upgradeRequested(req.Header) {
+			io.WriteString(c, "HTTP/1.1 426 Upgrade Required\r\n"+
+				"Upgrade: spdy/3\r\nConnection: Upgrade, close\r\nContent-Length: 0\r\n\r\n")
+			c.Close()
+			return fmt.Errorf("spdy: %s did not ask to upgrade", c.RemoteAddr())
+		}
+		// The request is not served, but its body must not be taken for
+		// the start of the session.
+		if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+			c.Close()
+			return err
+		}
+		if err := switchProtocols(c); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	c.SetDeadline(time.Time{})
+	return srv.ServeConn(&peekedConn{c, br})
+}
+
+// sniffTimeout bounds how long a sniffing listener, or ServeCleartext, waits
+// for the first bytes of a connection, and how long either end of an upgrade
+// handshake waits for it to complete.
+const sniffTimeout = 10 * time.Second
+
+// sniffListener hands connections that start with a SPDY control frame to a
+// Server and returns the rest from Accept.
+type sniffListener struct {
+	net.Listener
+	srv    *Server
+	conns  chan net.Conn
+	failed chan struct{} // closed once err is set
+	err    error
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewSniffListener returns a listener that peeks at the first bytes of each
+// connection accepted on l. Connections that start with a SPDY/3 control
+// frame, as Framer.ReadFrame expects, are served by srv with prior
+// knowledge; the rest, such as HTTP/1.1, are returned by Accept, for an
+// http.Server to serve. Either way the peeked bytes are read again from the
+// start of the connection.
+func NewSniffListener(l net.Listener, srv *Server) net.Listener {
+	sl := &sniffListener{
+		Listener: l,
+		srv:      srv,
+		conns:    make(chan net.Conn),
+		failed:   make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go sl.acceptLoop()
+	return sl
+}
+
+func (sl *sniffListener) acceptLoop() {
+	for {
+		c, err := sl.Listener.Accept()
+		if err != nil {
+			sl.err = err
+			close(sl.failed)
+			return
+		}
+		go sl.sniff(c)
+	}
+}
+
+func (sl *sniffListener) sniff(c net.Conn) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	first, err := br.Peek(2)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return
+	}
+	pc := &peekedConn{c, br}
+	if isControlWord(first) {
+		sl.srv.ServeConn(pc)
+		return
+	}
+	select {
+	case sl.conns <- pc:
+	case <-sl.closed:
+		c.Close()
+	}
+}
+
+// Accept returns the next connection that is not SPDY.
+func (sl *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-sl.conns:
+		return c, nil
+	case <-sl.failed:
+		return nil, sl.err
+	case <-sl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener. Sessions already being served carry
+// on.
+func (sl *sniffListener) Close() error {
+	err := net.ErrClosed
+	sl.once.Do(func() {
+		close(sl.closed)
+		err = sl.Listener.Close()
+	})
+	return err
+}
+
+// UpgradeHandler returns a handler that switches HTTP/1.1 connections
+// asking to upgrade to spdy/3 over to a SPDY session served by srv, and
+// passes other requests to h. The request carrying the handshake is not
+// itself served: the client sends it again on the session if it needs a
+// response. Requests with a body are not upgraded, so that the body is not
+// lost, but passed to h like the rest.
+func (srv *Server) UpgradeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if r.ProtoMajor != 1 || !upgradeRequested(r.Header) || r.ContentLength != 0 || !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		c, brw, err := hj.Hijack()
+		if err != nil {
+			srv.logf("spdy: upgrade from %s: %v", r.RemoteAddr, err)
+			return
+		}
+		// Deadlines set for the request, such as an http.Server's
+		// ReadTimeout and WriteTimeout, are not for the session that
+		// replaces it, and not every Hijacker clears them.
+		c.SetDeadline(time.Time{})
+		if err := switchProtocols(c); err != nil {
+			c.Close()
+			return
+		}
+		srv.ServeConn(&peekedConn{c, brw.Reader})
+	})
+}
+
+// upgradeRequested reports whether h asks to upgrade the connection to
+// spdy/3.
+func upgradeRequested(h http.Header) bool {
+	return hasToken(h["Connection"], "upgrade") && hasToken(h["Upgrade"], "spdy/3")
+}
+
+// hasToken reports whether the comma-separated header values hold token.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func switchProtocols(w io.Writer) error {
+	_, err := io.WriteString(w, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Connection: Upgrade\r\nUpgrade: spdy/3\r\n\r\n")
+	return err
+}
+
+// upgradeConn asks the server at the other end of c, which is addressed as
+// host, to switch to spdy/3. It returns the connection to start the
+// session on.
+func upgradeConn(c net.Conn, host string) (net.Conn, error) {
+	// A server that accepts the connection but never answers must not
+	// hold up the dial for ever.
+	c.SetDeadline(time.Now().Add(sniffTimeout))
+	_, err := io.WriteString(c, "OPTIONS / HTTP/1.1\r\nHost: "+host+"\r\n"+
+		"Connection: Upgrade\r\nUpgrade: spdy/3\r\n\r\n")
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || !hasToken(resp.Header["Upgrade"], "spdy/3") {
+		return nil, fmt.Errorf("spdy: %s refused to upgrade: %s", host, resp.Status)
+	}
+	c.SetDeadline(time.Time{})
+	return &peekedConn{c, br}, nil
+}
+
+// peekedConn is a connection whose first bytes have been read into r
+// already. Reads drain r before reading the connection.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
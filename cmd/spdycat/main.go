@@ -0,0 +1,272 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Spdycat decodes a raw SPDY/3 byte stream, such as one direction of a
+// decrypted TLS capture or a proxy log, and prints one frame per line.
+//
+// Usage:
+//
+//	spdycat [flags] [file]
+//
+// With no file, or with -, spdycat reads standard input. The flags are:
+//
+//	-json
+//		print each frame as a JSON object, in the schema of the spdy
+//		package's MarshalJSON methods
+//	-stream id
+//		print only frames of the given stream
+//	-type name
+//		print only frames of the given type, such as SYN_STREAM or DATA
+//	-http
+//		reassemble each stream into an HTTP/1.1-style transcript of its
+//		headers and body, printed once the stream ends; it cannot be
+//		combined with -json
+//
+// Frames are read leniently: violations of the spec that a frame can still
+// be decoded past, such as a frame of SPDY/2, are printed to standard error
+// as warnings, and the frame is printed as usual.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+var (
+	jsonOutput = flag.Bool("json", false, "print each frame as a JSON object")
+	streamId   = flag.Uint("stream", 0, "print only frames of this stream")
+	frameType  = flag.String("type", "", "print only frames of this type")
+	httpMode   = flag.Bool("http", false, "print an HTTP/1.1-style transcript of each stream")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: spdycat [flags] [file]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if err := checkFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "spdycat: %v\n", err)
+		usage()
+	}
+	var in io.Reader = os.Stdin
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		if name := flag.Arg(0); name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				fatalf("%v", err)
+			}
+			defer f.Close()
+			in = f
+		}
+	default:
+		usage()
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	err := cat(bufio.NewReader(in), out, os.Stderr)
+	out.Flush()
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spdycat: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// checkFlags reports flags that cannot be used together.
+func checkFlags() error {
+	if *httpMode && *jsonOutput {
+		return errors.New("-http and -json cannot be combined")
+	}
+	return nil
+}
+
+// cat decodes the frames read from r and prints them to w, and the
+// violations of the spec it tolerates to warn.
+func cat(r io.Reader, w, warn io.Writer) error {
+	framer, err := spdy.NewFramer(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	framer.SetParseMode(spdy.ParseLenient)
+	framer.SetHooks(&spdy.FrameHooks{OnWarning: func(e *spdy.Error) {
+		fmt.Fprintf(warn, "spdycat: warning: %v\n", e)
+	}})
+	var t *transcripts
+	if *httpMode {
+		t = newTranscripts(w)
+		defer t.flushAll()
+	}
+	for {
+		h, err := framer.ReadFrameHeader()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Every frame is decoded, even those left out, to keep the header
+		// compression context.
+		frame, err := framer.ReadFrameBody(h)
+		if err != nil {
+			return err
+		}
+		if *streamId != 0 && h.StreamId != spdy.StreamId(*streamId) {
+			continue
+		}
+		name := "DATA"
+		if h.Control {
+			name = h.Type.String()
+		}
+		if *frameType != "" && !strings.EqualFold(*frameType, name) {
+			continue
+		}
+		switch {
+		case t != nil:
+			t.add(frame)
+		case *jsonOutput:
+			b, err := json.Marshal(frame)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\n", b)
+		default:
+			fmt.Fprintln(w, frame)
+		}
+	}
+}
+
+// transcript is what has been seen of one stream.
+type transcript struct {
+	id      spdy.StreamId
+	header  http.Header
+	trailer http.Header
+	body    []byte
+	reset   string
+}
+
+// transcripts reassembles streams and prints each one as it ends.
+type transcripts struct {
+	w       io.Writer
+	streams map[spdy.StreamId]*transcript
+}
+
+func newTranscripts(w io.Writer) *transcripts {
+	return &transcripts{w: w, streams: make(map[spdy.StreamId]*transcript)}
+}
+
+func (t *transcripts) stream(id spdy.StreamId) *transcript {
+	s := t.streams[id]
+	if s == nil {
+		s = &transcript{id: id}
+		t.streams[id] = s
+	}
+	return s
+}
+
+func (t *transcripts) add(frame spdy.Frame) {
+	switch frame := frame.(type) {
+	case *spdy.SynStreamFrame:
+		t.stream(frame.StreamId).header = frame.Headers
+		if frame.CFHeader.Flags&spdy.ControlFlagFin != 0 {
+			t.flush(frame.StreamId)
+		}
+	case *spdy.SynReplyFrame:
+		t.stream(frame.StreamId).header = frame.Headers
+		if frame.CFHeader.Flags&spdy.ControlFlagFin != 0 {
+			t.flush(frame.StreamId)
+		}
+	case *spdy.HeadersFrame:
+		s := t.stream(frame.StreamId)
+		if s.trailer == nil {
+			s.trailer = make(http.Header)
+		}
+		for name, values := range frame.Headers {
+			s.trailer[name] = append(s.trailer[name], values...)
+		}
+		if frame.CFHeader.Flags&spdy.ControlFlagFin != 0 {
+			t.flush(frame.StreamId)
+		}
+	case *spdy.DataFrame:
+		s := t.stream(frame.StreamId)
+		s.body = append(s.body, frame.Data...)
+		if frame.Flags&spdy.DataFlagFin != 0 {
+			t.flush(frame.StreamId)
+		}
+	case *spdy.RstStreamFrame:
+		t.stream(frame.StreamId).reset = frame.Status.String()
+		t.flush(frame.StreamId)
+	}
+}
+
+// flushAll prints the streams that were still open at the end of input.
+func (t *transcripts) flushAll() {
+	ids := make([]int, 0, len(t.streams))
+	for id := range t.streams {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		t.flush(spdy.StreamId(id))
+	}
+}
+
+func (t *transcripts) flush(id spdy.StreamId) {
+	s := t.streams[id]
+	if s == nil {
+		return
+	}
+	delete(t.streams, id)
+	fmt.Fprintf(t.w, "=== stream %d ===\n", s.id)
+	h := s.header
+	if h.Get(":method") != "" {
+		fmt.Fprintf(t.w, "%s %s %s\r\n", h.Get(":method"), h.Get(":path"), h.Get(":version"))
+		if host := h.Get(":host"); host != "" {
+			fmt.Fprintf(t.w, "Host: %s\r\n", host)
+		}
+	} else if h.Get(":status") != "" {
+		fmt.Fprintf(t.w, "%s %s\r\n", h.Get(":version"), h.Get(":status"))
+	}
+	writeHeader(t.w, h)
+	fmt.Fprintf(t.w, "\r\n")
+	t.w.Write(s.body)
+	if len(s.trailer) > 0 {
+		fmt.Fprintf(t.w, "\r\n")
+		writeHeader(t.w, s.trailer)
+	}
+	if s.reset != "" {
+		fmt.Fprintf(t.w, "\n(stream reset: %s)", s.reset)
+	}
+	fmt.Fprintf(t.w, "\n")
+}
+
+// writeHeader writes h in wire format, leaving out SPDY's special headers.
+func writeHeader(w io.Writer, h http.Header) {
+	plain := make(http.Header, len(h))
+	for name, values := range h {
+		if !strings.HasPrefix(name, ":") {
+			plain[name] = values
+		}
+	}
+	plain.Write(w)
+}
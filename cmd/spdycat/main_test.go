@@ -0,0 +1,143 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+// capture returns frames as one endpoint would have sent them.
+func capture(t *testing.T, frames ...spdy.Frame) []byte {
+	var buf bytes.Buffer
+	framer, err := spdy.NewFramer(&buf, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatal("WriteFrame:", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// setFlags sets the flags for one test, restoring them when it ends.
+func setFlags(t *testing.T, json, http bool, stream uint, typ string) {
+	saved := []interface{}{*jsonOutput, *httpMode, *streamId, *frameType}
+	*jsonOutput, *httpMode, *streamId, *frameType = json, http, stream, typ
+	t.Cleanup(func() {
+		*jsonOutput = saved[0].(bool)
+		*httpMode = saved[1].(bool)
+		*streamId = saved[2].(uint)
+		*frameType = saved[3].(string)
+	})
+}
+
+var testFrames = []spdy.Frame{
+	&spdy.SynStreamFrame{StreamId: 1, Headers: http.Header{
+		":method": {"GET"}, ":path": {"/"}, ":version": {"HTTP/1.1"}, ":host": {"example.com"},
+	}},
+	&spdy.SynStreamFrame{StreamId: 3, Headers: http.Header{":path": {"/x"}}},
+	&spdy.DataFrame{StreamId: 1, Flags: spdy.DataFlagFin, Data: []byte("hello")},
+	&spdy.PingFrame{Id: 2},
+}
+
+func TestCat(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		json   bool
+		http   bool
+		stream uint
+		typ    string
+		want   string
+	}{
+		{
+			name: "all",
+			want: `SYN_STREAM stream=1 assoc=0 pri=0 slot=0 flags=0 headers={:host="example.com" :method="GET" :path="/" :version="HTTP/1.1"}
+SYN_STREAM stream=3 assoc=0 pri=0 slot=0 flags=0 headers={:path="/x"}
+DATA stream=1 flags=FIN length=5
+PING id=2
+`,
+		},
+		{
+			name:   "stream",
+			stream: 3,
+			want: `SYN_STREAM stream=3 assoc=0 pri=0 slot=0 flags=0 headers={:path="/x"}
+`,
+		},
+		{
+			name: "type",
+			typ:  "ping",
+			want: "PING id=2\n",
+		},
+		{
+			name: "json",
+			json: true,
+			typ:  "DATA",
+			want: `{"type":"DATA","stream_id":1,"flags":["FIN"],"data":"aGVsbG8="}` + "\n",
+		},
+		{
+			name:   "http",
+			http:   true,
+			stream: 1,
+			want:   "=== stream 1 ===\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\nhello\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.json, tt.http, tt.stream, tt.typ)
+			var out, warn bytes.Buffer
+			if err := cat(bytes.NewReader(capture(t, testFrames...)), &out, &warn); err != nil {
+				t.Fatal("cat:", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if warn.Len() != 0 {
+				t.Errorf("warned %q; want nothing", warn.String())
+			}
+		})
+	}
+}
+
+func TestCatLenient(t *testing.T) {
+	setFlags(t, false, false, 0, "")
+	// A PING of SPDY/2, then one of SPDY/3.
+	in := append([]byte{0x80, 2, 0, byte(spdy.TypePing), 0, 0, 0, 4, 0, 0, 0, 1}, capture(t, &spdy.PingFrame{Id: 3})...)
+	var out, warn bytes.Buffer
+	if err := cat(bytes.NewReader(in), &out, &warn); err != nil {
+		t.Fatal("cat:", err)
+	}
+	if want := "PING id=1\nPING id=3\n"; out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if !strings.HasPrefix(warn.String(), "spdycat: warning: ") || strings.Count(warn.String(), "\n") != 1 {
+		t.Errorf("warned %q; want one warning", warn.String())
+	}
+}
+
+func TestCatError(t *testing.T) {
+	setFlags(t, false, false, 0, "")
+	in := []byte{0x80, spdy.Version, 0, 0x63, 0, 0, 0, 0}
+	var out, warn bytes.Buffer
+	if err := cat(bytes.NewReader(in), &out, &warn); err == nil {
+		t.Error("cat of an unknown frame type succeeded")
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	setFlags(t, true, true, 0, "")
+	if err := checkFlags(); err == nil {
+		t.Error("checkFlags accepted -http with -json")
+	}
+	setFlags(t, true, false, 0, "")
+	if err := checkFlags(); err != nil {
+		t.Errorf("checkFlags rejected -json: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Spdyconform runs the SPDY/3 conformance suite against a server.
+//
+// Usage:
+//
+//	spdyconform [flags] host:port
+//
+// The flags are:
+//
+//	-tls
+//		connect with TLS, negotiating spdy/3 (default true)
+//	-insecure
+//		do not verify the server's certificate
+//	-host name
+//		the :host of requests (default the host in host:port)
+//	-run regexp
+//		run only the cases whose names match
+//	-timeout d
+//		how long to wait for each answer (default 5s)
+//	-v
+//		print passing cases as well as failing ones
+//
+// Spdyconform exits with status 1 if any case fails.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Jxck/go-spdy/conformance"
+)
+
+var (
+	useTLS   = flag.Bool("tls", true, "connect with TLS, negotiating spdy/3")
+	insecure = flag.Bool("insecure", false, "do not verify the server's certificate")
+	host     = flag.String("host", "", "the :host of requests")
+	run      = flag.String("run", "", "run only the cases whose names match this regexp")
+	timeout  = flag.Duration("timeout", 5*time.Second, "how long to wait for each answer")
+	verbose  = flag.Bool("v", false, "print passing cases as well")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: spdyconform [flags] host:port\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	addr := flag.Arg(0)
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *host == "" {
+		*host = hostname
+	}
+
+	cfg := &conformance.Config{
+		Dial:    func() (net.Conn, error) { return dial(addr, hostname) },
+		Host:    *host,
+		Timeout: *timeout,
+	}
+	results, err := cfg.Run(*run)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s: %v\n", r.Case.Name, r.Case.Desc, r.Err)
+		} else if *verbose {
+			fmt.Printf("PASS %s\n", r.Case.Name)
+		}
+	}
+	fmt.Printf("%d of %d cases passed\n", len(results)-failed, len(results))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func dial(addr, hostname string) (net.Conn, error) {
+	if !*useTLS {
+		return net.DialTimeout("tcp", addr, *timeout)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: *timeout}, "tcp", addr, &tls.Config{
+		ServerName:         hostname,
+		NextProtos:         []string{"spdy/3"},
+		InsecureSkipVerify: *insecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "spdy/3" {
+		conn.Close()
+		return nil, fmt.Errorf("server negotiated %q, not spdy/3", p)
+	}
+	return conn, nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spdyconform: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,402 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conformance checks how a SPDY/3 server handles malformed and
+// out-of-order frames. Each Case opens a connection of its own, sends
+// frames built with the spdy package's Framer, patched where the Framer
+// refuses to write them, and checks that the server answers with the
+// RST_STREAM or GOAWAY status the draft specifies.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+// A Config describes the endpoint under test.
+type Config struct {
+	// Dial opens a new connection to the endpoint, after any TLS
+	// handshake.
+	Dial func() (net.Conn, error)
+
+	// Host is sent as the :host of requests. If empty, "localhost" is
+	// used.
+	Host string
+
+	// Timeout limits the wait for each answer. If zero, 5 seconds is used.
+	Timeout time.Duration
+}
+
+// A Case is one conformance check.
+type Case struct {
+	Name string
+	Desc string
+	Run  func(c *Conn) error
+}
+
+// A Result is the outcome of a Case. Err is nil if the case passed.
+type Result struct {
+	Case *Case
+	Err  error
+}
+
+// Run runs the cases whose names match pattern, or all cases if pattern is
+// empty, in order.
+func (cfg *Config) Run(pattern string) ([]Result, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var results []Result
+	for i := range Cases {
+		c := &Cases[i]
+		if re.MatchString(c.Name) {
+			results = append(results, Result{c, cfg.RunCase(c)})
+		}
+	}
+	return results, nil
+}
+
+// RunCase runs c on a new connection.
+func (cfg *Config) RunCase(c *Case) error {
+	nc, err := cfg.Dial()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	conn, err := newConn(cfg, nc)
+	if err != nil {
+		return err
+	}
+	return c.Run(conn)
+}
+
+// A Conn is the suite's end of a connection to the endpoint under test.
+type Conn struct {
+	cfg    *Config
+	nc     net.Conn
+	out    bytes.Buffer // frames encoded but not yet sent
+	framer *spdy.Framer
+}
+
+func newConn(cfg *Config, nc net.Conn) (*Conn, error) {
+	c := &Conn{cfg: cfg, nc: nc}
+	framer, err := spdy.NewFramer(&c.out, bufio.NewReader(nc))
+	if err != nil {
+		return nil, err
+	}
+	c.framer = framer
+	return c, nil
+}
+
+func (c *Conn) timeout() time.Duration {
+	if c.cfg.Timeout > 0 {
+		return c.cfg.Timeout
+	}
+	return 5 * time.Second
+}
+
+// Encode encodes frame, keeping the header compression context in step,
+// and returns its bytes for the caller to patch and send with WriteRaw.
+func (c *Conn) Encode(frame spdy.Frame) ([]byte, error) {
+	if err := c.framer.WriteFrame(frame); err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), c.out.Bytes()...)
+	c.out.Reset()
+	return b, nil
+}
+
+// WriteFrame sends frames.
+func (c *Conn) WriteFrame(frames ...spdy.Frame) error {
+	for _, frame := range frames {
+		b, err := c.Encode(frame)
+		if err != nil {
+			return err
+		}
+		if err := c.WriteRaw(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRaw sends b as it is.
+func (c *Conn) WriteRaw(b []byte) error {
+	c.nc.SetWriteDeadline(time.Now().Add(c.timeout()))
+	_, err := c.nc.Write(b)
+	return err
+}
+
+// Request returns the header of a request for path on the endpoint.
+func (c *Conn) Request(method, path string) http.Header {
+	host := c.cfg.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return http.Header{
+		":method":  {method},
+		":path":    {path},
+		":version": {"HTTP/1.1"},
+		":host":    {host},
+		":scheme":  {"https"},
+	}
+}
+
+// expect reads frames until match reports that one settles the case,
+// returning match's verdict. It fails if the connection ends or the
+// timeout passes first.
+func (c *Conn) expect(what string, match func(spdy.Frame) (bool, error)) error {
+	c.nc.SetReadDeadline(time.Now().Add(c.timeout()))
+	for {
+		frame, err := c.framer.ReadFrame()
+		if err == io.EOF {
+			return fmt.Errorf("connection closed; want %s", what)
+		}
+		if err != nil {
+			return fmt.Errorf("%v; want %s", err, what)
+		}
+		if done, err := match(frame); done {
+			return err
+		}
+	}
+}
+
+// ExpectGoAway waits for a GOAWAY frame with the given status. Frames
+// before it, resets included, concern streams the case opened and are
+// skipped.
+func (c *Conn) ExpectGoAway(status spdy.GoAwayStatus) error {
+	what := fmt.Sprintf("GOAWAY %v", status)
+	return c.expect(what, func(frame spdy.Frame) (bool, error) {
+		if frame, ok := frame.(*spdy.GoAwayFrame); ok {
+			if frame.Status != status {
+				return true, fmt.Errorf("got %v; want %s", frame, what)
+			}
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// ExpectReset waits for a RST_STREAM frame for stream id with the given
+// status.
+func (c *Conn) ExpectReset(id spdy.StreamId, status spdy.RstStreamStatus) error {
+	what := fmt.Sprintf("RST_STREAM stream=%d status=%v", id, status)
+	return c.expect(what, func(frame spdy.Frame) (bool, error) {
+		switch frame := frame.(type) {
+		case *spdy.RstStreamFrame:
+			if frame.StreamId != id || frame.Status != status {
+				return true, fmt.Errorf("got %v; want %s", frame, what)
+			}
+			return true, nil
+		case *spdy.GoAwayFrame:
+			return true, fmt.Errorf("got %v; want %s", frame, what)
+		}
+		return false, nil
+	})
+}
+
+// ExpectPing waits for a PING frame with the given id.
+func (c *Conn) ExpectPing(id uint32) error {
+	what := fmt.Sprintf("PING id=%d", id)
+	return c.expect(what, func(frame spdy.Frame) (bool, error) {
+		switch frame := frame.(type) {
+		case *spdy.PingFrame:
+			if frame.Id != id {
+				return true, fmt.Errorf("got %v; want %s", frame, what)
+			}
+			return true, nil
+		case *spdy.GoAwayFrame, *spdy.RstStreamFrame:
+			return true, fmt.Errorf("got %v; want %s", frame, what)
+		}
+		return false, nil
+	})
+}
+
+// controlFrame returns a control frame of the given type with a payload
+// written as is, whatever its length.
+func controlFrame(frameType spdy.ControlFrameType, flags uint8, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:], 0x8000|spdy.Version)
+	binary.BigEndian.PutUint16(b[2:], uint16(frameType))
+	binary.BigEndian.PutUint32(b[4:], uint32(flags)<<24|uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func uint32s(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.BigEndian.PutUint32(b[4*i:], x)
+	}
+	return b
+}
+
+// Cases is the conformance suite.
+var Cases = []Case{
+	{
+		Name: "ping",
+		Desc: "a PING from the client is echoed",
+		Run: func(c *Conn) error {
+			if err := c.WriteFrame(&spdy.PingFrame{Id: 1}); err != nil {
+				return err
+			}
+			return c.ExpectPing(1)
+		},
+	},
+	{
+		Name: "ping-flags",
+		Desc: "a PING with flags set is a session error",
+		Run: func(c *Conn) error {
+			if err := c.WriteRaw(controlFrame(spdy.TypePing, 0x01, uint32s(1))); err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+	{
+		Name: "syn-stream-zero-id",
+		Desc: "a SYN_STREAM for stream 0 is a session error",
+		Run: func(c *Conn) error {
+			b, err := c.Encode(&spdy.SynStreamFrame{StreamId: 1, Headers: c.Request("GET", "/")})
+			if err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint32(b[8:], 0)
+			if err := c.WriteRaw(b); err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+	{
+		Name: "syn-stream-even-id",
+		Desc: "a SYN_STREAM from the client with an even stream id is a session error",
+		Run: func(c *Conn) error {
+			if err := c.WriteFrame(&spdy.SynStreamFrame{StreamId: 2, Headers: c.Request("GET", "/")}); err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+	{
+		Name: "syn-stream-decreasing-id",
+		Desc: "a SYN_STREAM with a stream id lower than an earlier one is a session error",
+		Run: func(c *Conn) error {
+			err := c.WriteFrame(
+				&spdy.SynStreamFrame{StreamId: 3, Headers: c.Request("GET", "/")},
+				&spdy.SynStreamFrame{StreamId: 1, Headers: c.Request("GET", "/")},
+			)
+			if err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+	{
+		Name: "syn-stream-duplicate-id",
+		Desc: "a second SYN_STREAM for an open stream is a stream error",
+		Run: func(c *Conn) error {
+			err := c.WriteFrame(
+				&spdy.SynStreamFrame{StreamId: 1, Headers: c.Request("POST", "/")},
+				&spdy.SynStreamFrame{StreamId: 1, Headers: c.Request("POST", "/")},
+			)
+			if err != nil {
+				return err
+			}
+			return c.ExpectReset(1, spdy.ProtocolError)
+		},
+	},
+	{
+		Name: "bad-zlib",
+		Desc: "a header block that does not decompress is an internal session error",
+		Run: func(c *Conn) error {
+			payload := append(uint32s(1, 0), 0, 0)
+			payload = append(payload, "not a zlib stream"...)
+			if err := c.WriteRaw(controlFrame(spdy.TypeSynStream, 0, payload)); err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayInternalError)
+		},
+	},
+	{
+		Name: "goaway-length",
+		Desc: "a GOAWAY whose length is not 8 is a session error",
+		Run: func(c *Conn) error {
+			if err := c.WriteRaw(controlFrame(spdy.TypeGoAway, 0, uint32s(0))); err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+	{
+		Name: "rst-stream-zero-id",
+		Desc: "a RST_STREAM for stream 0 is a session error",
+		Run: func(c *Conn) error {
+			if err := c.WriteRaw(controlFrame(spdy.TypeRstStream, 0, uint32s(0, uint32(spdy.Cancel)))); err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+	{
+		Name: "data-unknown-stream",
+		Desc: "DATA for a stream that was never opened is answered with INVALID_STREAM",
+		Run: func(c *Conn) error {
+			if err := c.WriteFrame(&spdy.DataFrame{StreamId: 5, Data: []byte("x")}); err != nil {
+				return err
+			}
+			return c.ExpectReset(5, spdy.InvalidStream)
+		},
+	},
+	{
+		Name: "window-overrun",
+		Desc: "DATA beyond the initial window is a FLOW_CONTROL_ERROR",
+		Run: func(c *Conn) error {
+			err := c.WriteFrame(
+				&spdy.SynStreamFrame{StreamId: 1, Headers: c.Request("POST", "/")},
+				&spdy.DataFrame{StreamId: 1, Data: make([]byte, 64<<10+1)},
+			)
+			if err != nil {
+				return err
+			}
+			return c.ExpectReset(1, spdy.FlowControlError)
+		},
+	},
+	{
+		Name: "window-update-overflow",
+		Desc: "a WINDOW_UPDATE taking the window past 2^31-1 is a FLOW_CONTROL_ERROR",
+		Run: func(c *Conn) error {
+			err := c.WriteFrame(
+				&spdy.SynStreamFrame{StreamId: 1, Headers: c.Request("POST", "/")},
+				&spdy.WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 1<<31 - 1},
+			)
+			if err != nil {
+				return err
+			}
+			return c.ExpectReset(1, spdy.FlowControlError)
+		},
+	},
+	{
+		Name: "settings-window-too-large",
+		Desc: "an initial window size past 2^31-1 is a session error",
+		Run: func(c *Conn) error {
+			err := c.WriteFrame(&spdy.SettingsFrame{FlagIdValues: []spdy.SettingsFlagIdValue{
+				{Id: spdy.SettingsInitialWindowSize, Value: 1 << 31},
+			}})
+			if err != nil {
+				return err
+			}
+			return c.ExpectGoAway(spdy.GoAwayProtocolError)
+		},
+	},
+}
@@ -0,0 +1,65 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+// TestServer runs the suite against spdy.Server.
+func TestServer(t *testing.T) {
+	srv := &spdy.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Hold POSTs open, so that the cases sending DATA find the
+			// stream still there.
+			if r.Method == "POST" {
+				<-r.Context().Done()
+			}
+		}),
+	}
+	cfg := &Config{
+		Dial: func() (net.Conn, error) {
+			c, s := net.Pipe()
+			go srv.ServeConn(s)
+			return c, nil
+		},
+		Timeout: time.Second,
+	}
+	for i := range Cases {
+		c := &Cases[i]
+		t.Run(c.Name, func(t *testing.T) {
+			if err := cfg.RunCase(c); err != nil {
+				t.Errorf("%s: %v", c.Desc, err)
+			}
+		})
+	}
+}
+
+func TestRunPattern(t *testing.T) {
+	cfg := &Config{Dial: func() (net.Conn, error) {
+		c, s := net.Pipe()
+		go func() {
+			ioutil.ReadAll(s)
+			s.Close()
+		}()
+		return c, nil
+	}, Timeout: 10 * time.Millisecond}
+	results, err := cfg.Run("^ping$")
+	if err != nil {
+		t.Fatal("Run:", err)
+	}
+	if len(results) != 1 || results[0].Case.Name != "ping" {
+		t.Fatalf("Run ran %v; want the ping case alone", results)
+	}
+	if results[0].Err == nil {
+		t.Error("ping case passed against a silent endpoint")
+	}
+}
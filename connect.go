@@ -0,0 +1,137 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DialTunnel opens a CONNECT stream on s asking the proxy at the other end
+// to connect to addr, given as host:port. Once the proxy has replied with a
+// 2xx status the returned stream carries the raw connection: Close
+// half-closes the tunnel, and CloseWithError tears it down.
+func DialTunnel(s *Session, addr string) (*Stream, error) {
+	h := http.Header{
+		":method":  {"CONNECT"},
+		":path":    {addr},
+		":host":    {addr},
+		":version": {"HTTP/1.1"},
+		":scheme":  {"https"},
+	}
+	st, err := s.OpenStream(h, false)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := st.Reply()
+	if err != nil {
+		return nil, err
+	}
+	if status := reply.Get(":status"); !strings.HasPrefix(status, "2") {
+		st.CloseWithError(Cancel)
+		return nil, fmt.Errorf("CONNECT %s: proxy replied %q", addr, status)
+	}
+	return st, nil
+}
+
+// ConnectProxy is an http.Handler for a Server that serves CONNECT requests
+// by dialing the requested address and piping bytes between the stream and
+// the new connection. An end of input on either side is passed on as a
+// half-close; an error on either side resets the stream and closes the
+// connection.
+//
+// ConnectProxy must be served by a Server, whose streams it tunnels over;
+// other ResponseWriters get a 501. Unless Allow or Dial restrict the
+// targets, it is an open proxy: any client can reach any address the
+// server can, including those behind its firewall.
+type ConnectProxy struct {
+	// Allow reports whether a tunnel to addr, the host:port asked for,
+	// may be opened. Refused requests get a 403. If nil, every target
+	// is allowed.
+	Allow func(addr string) bool
+
+	// Dial connects to the target. If nil, net.Dial is used.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+func (p *ConnectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT needs a SPDY stream to tunnel over", http.StatusNotImplemented)
+		return
+	}
+	if p.Allow != nil && !p.Allow(r.Host) {
+		http.Error(w, "tunnel to "+r.Host+" not allowed", http.StatusForbidden)
+		return
+	}
+	dial := p.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	target, err := dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	st, ok := conn.(*Stream)
+	if !ok {
+		// The reply has gone out; all that is left is to drop the
+		// connection.
+		conn.Close()
+		return
+	}
+	tunnel(st, target)
+}
+
+// closeWriter is implemented by connections that support half-close, such
+// as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tunnel copies between st and c in both directions until both are done.
+func tunnel(st *Stream, c net.Conn) {
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(c, st)
+		if err == nil {
+			if cw, ok := c.(closeWriter); ok {
+				err = cw.CloseWrite()
+			}
+		}
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(st, c)
+		if err == nil {
+			err = st.Close()
+		}
+		errc <- err
+	}()
+	aborted := false
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil && !aborted {
+			aborted = true
+			if _, ok := err.(*StreamResetError); !ok {
+				st.CloseWithError(InternalError)
+			}
+			c.Close()
+		}
+	}
+}
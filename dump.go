@@ -0,0 +1,237 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var frameTypeNames = map[ControlFrameType]string{
+	TypeSynStream:    "SYN_STREAM",
+	TypeSynReply:     "SYN_REPLY",
+	TypeRstStream:    "RST_STREAM",
+	TypeSettings:     "SETTINGS",
+	TypePing:         "PING",
+	TypeGoAway:       "GOAWAY",
+	TypeHeaders:      "HEADERS",
+	TypeWindowUpdate: "WINDOW_UPDATE",
+}
+
+func (t ControlFrameType) String() string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_TYPE(%d)", uint16(t))
+}
+
+var rstStreamStatusNames = map[RstStreamStatus]string{
+	ProtocolError:       "PROTOCOL_ERROR",
+	InvalidStream:       "INVALID_STREAM",
+	RefusedStream:       "REFUSED_STREAM",
+	UnsupportedVersion:  "UNSUPPORTED_VERSION",
+	Cancel:              "CANCEL",
+	InternalError:       "INTERNAL_ERROR",
+	FlowControlError:    "FLOW_CONTROL_ERROR",
+	StreamInUse:         "STREAM_IN_USE",
+	StreamAlreadyClosed: "STREAM_ALREADY_CLOSED",
+	InvalidCredentials:  "INVALID_CREDENTIALS",
+	FrameTooLarge:       "FRAME_TOO_LARGE",
+}
+
+func (s RstStreamStatus) String() string {
+	if name, ok := rstStreamStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_STATUS(%d)", uint32(s))
+}
+
+var goAwayStatusNames = map[GoAwayStatus]string{
+	GoAwayOK:            "OK",
+	GoAwayProtocolError: "PROTOCOL_ERROR",
+	GoAwayInternalError: "INTERNAL_ERROR",
+}
+
+func (s GoAwayStatus) String() string {
+	if name, ok := goAwayStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_STATUS(%d)", uint32(s))
+}
+
+var settingsIdNames = map[SettingsId]string{
+	SettingsUploadBandwidth:             "UPLOAD_BANDWIDTH",
+	SettingsDownloadBandwidth:           "DOWNLOAD_BANDWIDTH",
+	SettingsRoundTripTime:               "ROUND_TRIP_TIME",
+	SettingsMaxConcurrentStreams:        "MAX_CONCURRENT_STREAMS",
+	SettingsCurrentCwnd:                 "CURRENT_CWND",
+	SettingsDownloadRetransRate:         "DOWNLOAD_RETRANS_RATE",
+	SettingsInitialWindowSize:           "INITIAL_WINDOW_SIZE",
+	SettingsClientCretificateVectorSize: "CLIENT_CERTIFICATE_VECTOR_SIZE",
+}
+
+func (id SettingsId) String() string {
+	if name, ok := settingsIdNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ID(%d)", uint32(id))
+}
+
+// flagNames formats the set bits of flags with the given names, most
+// significant last, leaving unnamed bits in hex.
+func flagNames(flags uint8, names map[uint8]string) string {
+	if flags == 0 {
+		return "0"
+	}
+	var parts []string
+	for bit := uint8(1); bit != 0; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+		if name, ok := names[bit]; ok {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, fmt.Sprintf("0x%02x", bit))
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+var streamFlagNames = map[uint8]string{
+	uint8(ControlFlagFin):            "FIN",
+	uint8(ControlFlagUnidirectional): "UNIDIRECTIONAL",
+}
+
+var dataFlagNames = map[uint8]string{
+	uint8(DataFlagFin): "FIN",
+}
+
+var settingsFrameFlagNames = map[uint8]string{
+	uint8(ControlFlagSettingsClearSettings): "CLEAR_SETTINGS",
+}
+
+var settingsFlagNames = map[uint8]string{
+	uint8(FlagSettingsPersistValue): "PERSIST_VALUE",
+	uint8(FlagSettingsPersisted):    "PERSISTED",
+}
+
+// formatHeaders formats h with lowercased names in sorted order and quoted
+// values.
+func formatHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	lower := make(map[string]string, len(h))
+	for name := range h {
+		lname := strings.ToLower(name)
+		names = append(names, lname)
+		lower[lname] = name
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, lname := range names {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(lname)
+		buf.WriteByte('=')
+		for j, v := range h[lower[lname]] {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(&buf, "%q", v)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func (frame SynStreamFrame) String() string {
+	return fmt.Sprintf("SYN_STREAM stream=%d assoc=%d pri=%d slot=%d flags=%s headers=%s",
+		frame.StreamId, frame.AssociatedToStreamId, frame.Priority, frame.Slot,
+		flagNames(uint8(frame.CFHeader.Flags), streamFlagNames), formatHeaders(frame.Headers))
+}
+
+func (frame SynReplyFrame) String() string {
+	return fmt.Sprintf("SYN_REPLY stream=%d flags=%s headers=%s",
+		frame.StreamId, flagNames(uint8(frame.CFHeader.Flags), streamFlagNames), formatHeaders(frame.Headers))
+}
+
+func (frame RstStreamFrame) String() string {
+	return fmt.Sprintf("RST_STREAM stream=%d status=%v", frame.StreamId, frame.Status)
+}
+
+func (frame SettingsFrame) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "SETTINGS flags=%s values=[", flagNames(uint8(frame.CFHeader.Flags), settingsFrameFlagNames))
+	for i, v := range frame.FlagIdValues {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%v=%d", v.Id, v.Value)
+		if v.Flag != 0 {
+			fmt.Fprintf(&buf, "(%s)", flagNames(uint8(v.Flag), settingsFlagNames))
+		}
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+func (frame PingFrame) String() string {
+	return fmt.Sprintf("PING id=%d", frame.Id)
+}
+
+func (frame GoAwayFrame) String() string {
+	return fmt.Sprintf("GOAWAY last_good_stream=%d status=%v", frame.LastGoodStreamId, frame.Status)
+}
+
+func (frame HeadersFrame) String() string {
+	return fmt.Sprintf("HEADERS stream=%d flags=%s headers=%s",
+		frame.StreamId, flagNames(uint8(frame.CFHeader.Flags), streamFlagNames), formatHeaders(frame.Headers))
+}
+
+func (frame WindowUpdateFrame) String() string {
+	return fmt.Sprintf("WINDOW_UPDATE stream=%d delta=%d", frame.StreamId, frame.DeltaWindowSize)
+}
+
+func (frame DataFrame) String() string {
+	return fmt.Sprintf("DATA stream=%d flags=%s length=%d",
+		frame.StreamId, flagNames(uint8(frame.Flags), dataFlagNames), len(frame.Data))
+}
+
+// DumpFrames decodes the raw SPDY byte stream read from r, as sent by one
+// endpoint, and writes one line per frame to w. The header compression
+// context carries over from frame to frame, as on a live connection.
+// Frames are read in lenient mode, so that a violation of the spec that can
+// be decoded past is written to w as a warning before the frame. It stops
+// at the end of r, returning nil, or at the first error, which it also
+// writes to w.
+func DumpFrames(r io.Reader, w io.Writer) error {
+	framer, err := NewFramer(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	framer.SetParseMode(ParseLenient)
+	framer.SetHooks(&FrameHooks{OnWarning: func(e *Error) {
+		fmt.Fprintf(w, "warning: %v\n", e)
+	}})
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+			return err
+		}
+		if _, err := fmt.Fprintln(w, frame); err != nil {
+			return err
+		}
+	}
+}
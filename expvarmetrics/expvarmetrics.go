@@ -0,0 +1,201 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package expvarmetrics provides the expvar-backed default metrics of SPDY
+// sessions. Importing it, even only for its side effect,
+//
+//	import _ "github.com/Jxck/go-spdy/expvarmetrics"
+//
+// sets spdy.DefaultMetrics to Default, published as the expvar map "spdy",
+// and, through package expvar, registers the /debug/vars handler on
+// http.DefaultServeMux.
+package expvarmetrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+// Default is the Metrics published as "spdy", which collects the metrics of
+// sessions made without metrics of their own.
+var Default = New("spdy")
+
+func init() {
+	spdy.DefaultMetrics = Default
+}
+
+// Metrics is a spdy.Metrics that keeps its measurements in expvar
+// variables, in the style of Prometheus counters, gauges and histograms.
+type Metrics struct {
+	ActiveSessions expvar.Int
+	ActiveStreams  expvar.Int
+
+	FramesRead    expvar.Map // frames read, by type
+	FramesWritten expvar.Map // frames written, by type
+	BytesRead     expvar.Int
+	BytesWritten  expvar.Int
+
+	HeaderBytesUncompressed expvar.Int
+	HeaderBytesCompressed   expvar.Int
+
+	ResetsSent      expvar.Map // RST_STREAM frames sent, by status
+	ResetsReceived  expvar.Map // RST_STREAM frames received, by status
+	GoAwaysSent     expvar.Map // GOAWAY frames sent, by status
+	GoAwaysReceived expvar.Map // GOAWAY frames received, by status
+
+	PingRTTSeconds *Histogram
+
+	FlowControlStallSeconds expvar.Float // total time writes waited for window
+	FlowControlStalls       expvar.Int   // number of such waits
+}
+
+// New returns a Metrics published as an expvar map with the given name, or
+// not published at all if name is empty. Like expvar.Publish, it panics if
+// the name is already in use.
+func New(name string) *Metrics {
+	m := &Metrics{
+		PingRTTSeconds: NewHistogram(.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5),
+	}
+	m.FramesRead.Init()
+	m.FramesWritten.Init()
+	m.ResetsSent.Init()
+	m.ResetsReceived.Init()
+	m.GoAwaysSent.Init()
+	m.GoAwaysReceived.Init()
+
+	if name == "" {
+		return m
+	}
+	vars := expvar.NewMap(name)
+	vars.Set("active_sessions", &m.ActiveSessions)
+	vars.Set("active_streams", &m.ActiveStreams)
+	vars.Set("frames_read", &m.FramesRead)
+	vars.Set("frames_written", &m.FramesWritten)
+	vars.Set("bytes_read", &m.BytesRead)
+	vars.Set("bytes_written", &m.BytesWritten)
+	vars.Set("header_bytes_uncompressed", &m.HeaderBytesUncompressed)
+	vars.Set("header_bytes_compressed", &m.HeaderBytesCompressed)
+	vars.Set("header_compression_ratio", expvar.Func(m.headerCompressionRatio))
+	vars.Set("resets_sent", &m.ResetsSent)
+	vars.Set("resets_received", &m.ResetsReceived)
+	vars.Set("goaways_sent", &m.GoAwaysSent)
+	vars.Set("goaways_received", &m.GoAwaysReceived)
+	vars.Set("ping_rtt_seconds", m.PingRTTSeconds)
+	vars.Set("flow_control_stall_seconds", &m.FlowControlStallSeconds)
+	vars.Set("flow_control_stalls", &m.FlowControlStalls)
+	return m
+}
+
+// headerCompressionRatio returns how many times smaller header blocks are
+// on the wire than uncompressed.
+func (m *Metrics) headerCompressionRatio() interface{} {
+	compressed := m.HeaderBytesCompressed.Value()
+	if compressed == 0 {
+		return 0
+	}
+	return float64(m.HeaderBytesUncompressed.Value()) / float64(compressed)
+}
+
+func (m *Metrics) SessionOpened() { m.ActiveSessions.Add(1) }
+func (m *Metrics) SessionClosed() { m.ActiveSessions.Add(-1) }
+func (m *Metrics) StreamOpened()  { m.ActiveStreams.Add(1) }
+func (m *Metrics) StreamClosed()  { m.ActiveStreams.Add(-1) }
+
+func (m *Metrics) FrameRead(frameType string, wireBytes int) {
+	m.FramesRead.Add(frameType, 1)
+	m.BytesRead.Add(int64(wireBytes))
+}
+
+func (m *Metrics) FrameWritten(frameType string, wireBytes int) {
+	m.FramesWritten.Add(frameType, 1)
+	m.BytesWritten.Add(int64(wireBytes))
+}
+
+func (m *Metrics) HeadersCompressed(uncompressed, compressed int) {
+	m.HeaderBytesUncompressed.Add(int64(uncompressed))
+	m.HeaderBytesCompressed.Add(int64(compressed))
+}
+
+func (m *Metrics) StreamReset(status spdy.RstStreamStatus, remote bool) {
+	if remote {
+		m.ResetsReceived.Add(status.String(), 1)
+	} else {
+		m.ResetsSent.Add(status.String(), 1)
+	}
+}
+
+func (m *Metrics) GoAway(status spdy.GoAwayStatus, remote bool) {
+	if remote {
+		m.GoAwaysReceived.Add(status.String(), 1)
+	} else {
+		m.GoAwaysSent.Add(status.String(), 1)
+	}
+}
+
+func (m *Metrics) PingRTT(rtt time.Duration) {
+	m.PingRTTSeconds.Observe(rtt.Seconds())
+}
+
+func (m *Metrics) FlowControlStall(d time.Duration) {
+	m.FlowControlStallSeconds.Add(d.Seconds())
+	m.FlowControlStalls.Add(1)
+}
+
+// A Histogram counts observations in buckets with fixed upper bounds, as a
+// Prometheus histogram does. It is an expvar.Var, formatted as a JSON
+// object holding the cumulative count of each bucket, keyed by its upper
+// bound, and the count and sum of all observations.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64 // counts[i] is for bounds[i]; the last is for +Inf
+	count  int64
+	sum    float64
+}
+
+// NewHistogram returns a Histogram with buckets for the given upper
+// bounds, in increasing order, and one for +Inf.
+func NewHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var buf bytes.Buffer
+	buf.WriteString(`{"buckets": {`)
+	var cumulative int64
+	for i, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%q: %d", le, cumulative)
+	}
+	fmt.Fprintf(&buf, `}, "count": %d, "sum": %s}`, h.count, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	return buf.String()
+}
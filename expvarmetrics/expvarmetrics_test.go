@@ -0,0 +1,77 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expvarmetrics
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+var _ spdy.Metrics = (*Metrics)(nil)
+
+// runs numbers the runs of TestNew, which must publish under a new name
+// each time.
+var runs int
+
+func TestNew(t *testing.T) {
+	runs++
+	name := fmt.Sprintf("spdy_test_%d", runs)
+	m := New(name)
+	m.SessionOpened()
+	m.FrameRead("SYN_STREAM", 18)
+	m.FrameRead("SYN_STREAM", 20)
+	m.FrameWritten("DATA", 8)
+	m.StreamReset(spdy.Cancel, true)
+	m.PingRTT(2 * time.Millisecond)
+
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		t.Fatalf("%s is not published", name)
+	}
+	for key, want := range map[string]string{
+		"active_sessions": "1",
+		"frames_read":     `{"SYN_STREAM": 2}`,
+		"frames_written":  `{"DATA": 1}`,
+		"bytes_read":      "38",
+		"resets_received": `{"CANCEL": 1}`,
+	} {
+		v := vars.Get(key)
+		if v == nil {
+			t.Errorf("%s is not published", key)
+			continue
+		}
+		if got := v.String(); got != want {
+			t.Errorf("%s = %s; want %s", key, got, want)
+		}
+	}
+	if got := vars.Get("ping_rtt_seconds").String(); !strings.Contains(got, `"count": 1`) {
+		t.Errorf("ping_rtt_seconds = %s; want one observation", got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(1, 2)
+	for _, v := range []float64{0.5, 1, 1.5, 3} {
+		h.Observe(v)
+	}
+	want := `{"buckets": {"1": 2, "2": 3, "+Inf": 4}, "count": 4, "sum": 6}`
+	if got := h.String(); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	if spdy.DefaultMetrics != Default {
+		t.Errorf("spdy.DefaultMetrics = %v; want Default", spdy.DefaultMetrics)
+	}
+	if _, ok := expvar.Get("spdy").(*expvar.Map); !ok {
+		t.Error("Default is not published as spdy")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"io"
+)
+
+// FrameHooks are callbacks a Framer makes as it reads and writes frames, so
+// that tracing, metrics and logging can observe a connection. Any of them
+// may be nil. A Framer without hooks does no extra work.
+type FrameHooks struct {
+	// OnFrameRead is called after ReadFrame decodes a frame, with the
+	// number of bytes the frame took on the wire.
+	OnFrameRead func(frame Frame, wireBytes int)
+
+	// OnFrameWritten is called after WriteFrame writes a frame, with the
+	// number of bytes the frame took on the wire.
+	OnFrameWritten func(frame Frame, wireBytes int)
+
+	// OnHeadersDecompressed is called after a header block is read, with
+	// its size on the wire and its size once decompressed.
+	OnHeadersDecompressed func(streamId StreamId, compressed, decompressed int)
+
+	// OnHeadersCompressed is called after a header block is written, with
+	// its size before compression and its size on the wire.
+	OnHeadersCompressed func(streamId StreamId, uncompressed, compressed int)
+
+	// OnError is called with every error ReadFrame or WriteFrame returns.
+	OnError func(err error)
+
+	// OnWarning is called, in lenient parse mode, with each violation of
+	// the spec that ReadFrame tolerated.
+	OnWarning func(err *Error)
+}
+
+// SetHooks installs hooks on f, replacing any installed before. A nil hooks
+// removes them.
+func (f *Framer) SetHooks(hooks *FrameHooks) {
+	f.hooks = hooks
+}
+
+func (h *FrameHooks) frameRead(frame Frame, err error) {
+	if err != nil {
+		if h.OnError != nil {
+			h.OnError(err)
+		}
+		return
+	}
+	if h.OnFrameRead != nil {
+		h.OnFrameRead(frame, WireSize(frame))
+	}
+}
+
+func (h *FrameHooks) frameWritten(frame Frame, err error) {
+	if err != nil {
+		if h.OnError != nil {
+			h.OnError(err)
+		}
+		return
+	}
+	if h.OnFrameWritten != nil {
+		h.OnFrameWritten(frame, WireSize(frame))
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,546 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Frames marshal to JSON objects whose "type" member names the frame type
+// as the SPDY draft spells it. Flags are lists of flag names, statuses and
+// setting ids are names, header names are lowercased as on the wire, and
+// DATA payloads are base64. Lengths and versions are left out: they follow
+// from the rest of the frame. For example:
+//
+//	{"type":"SYN_STREAM","flags":["FIN"],"stream_id":1,"associated_stream_id":0,"priority":0,"slot":0,"headers":{":method":["GET"]}}
+//	{"type":"RST_STREAM","stream_id":1,"status":"CANCEL"}
+//	{"type":"DATA","stream_id":1,"flags":[],"data":"aGVsbG8="}
+//
+// A transcript is a JSON array of frames, as written by WriteTranscript.
+
+type synStreamJSON struct {
+	Type                 string      `json:"type"`
+	Flags                []string    `json:"flags"`
+	StreamId             StreamId    `json:"stream_id"`
+	AssociatedToStreamId StreamId    `json:"associated_stream_id"`
+	Priority             uint8       `json:"priority"`
+	Slot                 uint8       `json:"slot"`
+	Headers              http.Header `json:"headers"`
+}
+
+// headersJSON is the schema of both SYN_REPLY and HEADERS frames.
+type headersJSON struct {
+	Type     string      `json:"type"`
+	Flags    []string    `json:"flags"`
+	StreamId StreamId    `json:"stream_id"`
+	Headers  http.Header `json:"headers"`
+}
+
+type rstStreamJSON struct {
+	Type     string          `json:"type"`
+	StreamId StreamId        `json:"stream_id"`
+	Status   RstStreamStatus `json:"status"`
+}
+
+type settingJSON struct {
+	Id    SettingsId `json:"id"`
+	Flags []string   `json:"flags"`
+	Value uint32     `json:"value"`
+}
+
+type settingsJSON struct {
+	Type     string        `json:"type"`
+	Flags    []string      `json:"flags"`
+	Settings []settingJSON `json:"settings"`
+}
+
+type pingJSON struct {
+	Type string `json:"type"`
+	Id   uint32 `json:"id"`
+}
+
+type goAwayJSON struct {
+	Type             string       `json:"type"`
+	LastGoodStreamId StreamId     `json:"last_good_stream_id"`
+	Status           GoAwayStatus `json:"status"`
+}
+
+type windowUpdateJSON struct {
+	Type            string   `json:"type"`
+	StreamId        StreamId `json:"stream_id"`
+	DeltaWindowSize uint32   `json:"delta_window_size"`
+}
+
+type dataJSON struct {
+	Type     string   `json:"type"`
+	StreamId StreamId `json:"stream_id"`
+	Flags    []string `json:"flags"`
+	Data     []byte   `json:"data"`
+}
+
+// flagList returns the names of the flags set, as flagNames formats them.
+func flagList(flags uint8, names map[uint8]string) []string {
+	list := []string{}
+	if flags != 0 {
+		list = strings.Split(flagNames(flags, names), "|")
+	}
+	return list
+}
+
+// parseFlagList is the inverse of flagList.
+func parseFlagList(list []string, names map[uint8]string) (uint8, error) {
+	var flags uint8
+next:
+	for _, name := range list {
+		for bit, n := range names {
+			if n == name {
+				flags |= bit
+				continue next
+			}
+		}
+		bit, err := strconv.ParseUint(name, 0, 8)
+		if err != nil {
+			return 0, fmt.Errorf("unknown flag %q", name)
+		}
+		flags |= uint8(bit)
+	}
+	return flags, nil
+}
+
+// lowerHeaders returns h with its names lowercased, as they go on the wire.
+func lowerHeaders(h http.Header) http.Header {
+	if h == nil {
+		return http.Header{}
+	}
+	lower := make(http.Header, len(h))
+	for name, values := range h {
+		lower[strings.ToLower(name)] = values
+	}
+	return lower
+}
+
+// canonicalHeaders returns h with canonical names, as ReadFrame returns
+// them.
+func canonicalHeaders(h http.Header) http.Header {
+	canonical := make(http.Header, len(h))
+	for name, values := range h {
+		canonical[http.CanonicalHeaderKey(name)] = values
+	}
+	return canonical
+}
+
+// checkType reports an error if a frame of type got is unmarshaled into a
+// frame of type want.
+func checkType(got, want string) error {
+	if got != want {
+		return fmt.Errorf("cannot unmarshal %s frame into %s frame", got, want)
+	}
+	return nil
+}
+
+func (frame SynStreamFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(synStreamJSON{
+		Type:                 "SYN_STREAM",
+		Flags:                flagList(uint8(frame.CFHeader.Flags), streamFlagNames),
+		StreamId:             frame.StreamId,
+		AssociatedToStreamId: frame.AssociatedToStreamId,
+		Priority:             frame.Priority,
+		Slot:                 frame.Slot,
+		Headers:              lowerHeaders(frame.Headers),
+	})
+}
+
+func (frame *SynStreamFrame) UnmarshalJSON(b []byte) error {
+	var v synStreamJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "SYN_STREAM"); err != nil {
+		return err
+	}
+	flags, err := parseFlagList(v.Flags, streamFlagNames)
+	if err != nil {
+		return err
+	}
+	*frame = SynStreamFrame{
+		CFHeader:             ControlFrameHeader{Flags: ControlFlags(flags)},
+		StreamId:             v.StreamId,
+		AssociatedToStreamId: v.AssociatedToStreamId,
+		Priority:             v.Priority,
+		Slot:                 v.Slot,
+		Headers:              canonicalHeaders(v.Headers),
+	}
+	return nil
+}
+
+func (frame SynReplyFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(headersJSON{
+		Type:     "SYN_REPLY",
+		Flags:    flagList(uint8(frame.CFHeader.Flags), streamFlagNames),
+		StreamId: frame.StreamId,
+		Headers:  lowerHeaders(frame.Headers),
+	})
+}
+
+func (frame *SynReplyFrame) UnmarshalJSON(b []byte) error {
+	var v headersJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "SYN_REPLY"); err != nil {
+		return err
+	}
+	flags, err := parseFlagList(v.Flags, streamFlagNames)
+	if err != nil {
+		return err
+	}
+	*frame = SynReplyFrame{
+		CFHeader: ControlFrameHeader{Flags: ControlFlags(flags)},
+		StreamId: v.StreamId,
+		Headers:  canonicalHeaders(v.Headers),
+	}
+	return nil
+}
+
+func (frame RstStreamFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rstStreamJSON{"RST_STREAM", frame.StreamId, frame.Status})
+}
+
+func (frame *RstStreamFrame) UnmarshalJSON(b []byte) error {
+	var v rstStreamJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "RST_STREAM"); err != nil {
+		return err
+	}
+	*frame = RstStreamFrame{StreamId: v.StreamId, Status: v.Status}
+	return nil
+}
+
+func (frame SettingsFrame) MarshalJSON() ([]byte, error) {
+	v := settingsJSON{
+		Type:     "SETTINGS",
+		Flags:    flagList(uint8(frame.CFHeader.Flags), settingsFrameFlagNames),
+		Settings: make([]settingJSON, len(frame.FlagIdValues)),
+	}
+	for i, s := range frame.FlagIdValues {
+		v.Settings[i] = settingJSON{s.Id, flagList(uint8(s.Flag), settingsFlagNames), s.Value}
+	}
+	return json.Marshal(v)
+}
+
+func (frame *SettingsFrame) UnmarshalJSON(b []byte) error {
+	var v settingsJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "SETTINGS"); err != nil {
+		return err
+	}
+	flags, err := parseFlagList(v.Flags, settingsFrameFlagNames)
+	if err != nil {
+		return err
+	}
+	*frame = SettingsFrame{
+		CFHeader:     ControlFrameHeader{Flags: ControlFlags(flags)},
+		FlagIdValues: make([]SettingsFlagIdValue, len(v.Settings)),
+	}
+	for i, s := range v.Settings {
+		flag, err := parseFlagList(s.Flags, settingsFlagNames)
+		if err != nil {
+			return err
+		}
+		frame.FlagIdValues[i] = SettingsFlagIdValue{SettingsFlag(flag), s.Id, s.Value}
+	}
+	return nil
+}
+
+func (frame PingFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pingJSON{"PING", frame.Id})
+}
+
+func (frame *PingFrame) UnmarshalJSON(b []byte) error {
+	var v pingJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "PING"); err != nil {
+		return err
+	}
+	*frame = PingFrame{Id: v.Id}
+	return nil
+}
+
+func (frame GoAwayFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(goAwayJSON{"GOAWAY", frame.LastGoodStreamId, frame.Status})
+}
+
+func (frame *GoAwayFrame) UnmarshalJSON(b []byte) error {
+	var v goAwayJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "GOAWAY"); err != nil {
+		return err
+	}
+	*frame = GoAwayFrame{LastGoodStreamId: v.LastGoodStreamId, Status: v.Status}
+	return nil
+}
+
+func (frame HeadersFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(headersJSON{
+		Type:     "HEADERS",
+		Flags:    flagList(uint8(frame.CFHeader.Flags), streamFlagNames),
+		StreamId: frame.StreamId,
+		Headers:  lowerHeaders(frame.Headers),
+	})
+}
+
+func (frame *HeadersFrame) UnmarshalJSON(b []byte) error {
+	var v headersJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "HEADERS"); err != nil {
+		return err
+	}
+	flags, err := parseFlagList(v.Flags, streamFlagNames)
+	if err != nil {
+		return err
+	}
+	*frame = HeadersFrame{
+		CFHeader: ControlFrameHeader{Flags: ControlFlags(flags)},
+		StreamId: v.StreamId,
+		Headers:  canonicalHeaders(v.Headers),
+	}
+	return nil
+}
+
+func (frame WindowUpdateFrame) MarshalJSON() ([]byte, error) {
+	return json.Marshal(windowUpdateJSON{"WINDOW_UPDATE", frame.StreamId, frame.DeltaWindowSize})
+}
+
+func (frame *WindowUpdateFrame) UnmarshalJSON(b []byte) error {
+	var v windowUpdateJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "WINDOW_UPDATE"); err != nil {
+		return err
+	}
+	*frame = WindowUpdateFrame{StreamId: v.StreamId, DeltaWindowSize: v.DeltaWindowSize}
+	return nil
+}
+
+func (frame DataFrame) MarshalJSON() ([]byte, error) {
+	data := frame.Data
+	if data == nil {
+		data = []byte{}
+	}
+	return json.Marshal(dataJSON{"DATA", frame.StreamId, flagList(uint8(frame.Flags), dataFlagNames), data})
+}
+
+func (frame *DataFrame) UnmarshalJSON(b []byte) error {
+	var v dataJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if err := checkType(v.Type, "DATA"); err != nil {
+		return err
+	}
+	flags, err := parseFlagList(v.Flags, dataFlagNames)
+	if err != nil {
+		return err
+	}
+	if v.Data == nil {
+		v.Data = []byte{}
+	}
+	*frame = DataFrame{StreamId: v.StreamId, Flags: DataFlags(flags), Data: v.Data}
+	return nil
+}
+
+// UnmarshalFrame decodes a frame of any type from its JSON form.
+func UnmarshalFrame(b []byte) (Frame, error) {
+	var v struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	var frame Frame
+	switch v.Type {
+	case "DATA":
+		frame = new(DataFrame)
+	default:
+		ctor, ok := frameCtorByName[v.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown frame type %q", v.Type)
+		}
+		frame = ctor()
+	}
+	if err := json.Unmarshal(b, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+var frameCtorByName = func() map[string]func() controlFrame {
+	m := make(map[string]func() controlFrame, len(cframeCtor))
+	for t, ctor := range cframeCtor {
+		m[t.String()] = ctor
+	}
+	return m
+}()
+
+// parseName returns the value whose name is s in names. It also accepts the
+// decimal form used for unknown values, such as "UNKNOWN_STATUS(12)".
+func parseName(s string, names map[uint32]string) (uint32, error) {
+	for v, name := range names {
+		if name == s {
+			return v, nil
+		}
+	}
+	if i, j := strings.Index(s, "("), strings.LastIndex(s, ")"); i >= 0 && j == len(s)-1 {
+		if v, err := strconv.ParseUint(s[i+1:j], 10, 32); err == nil {
+			return uint32(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown name %q", s)
+}
+
+func (s RstStreamStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *RstStreamStatus) UnmarshalText(b []byte) error {
+	names := make(map[uint32]string, len(rstStreamStatusNames))
+	for v, name := range rstStreamStatusNames {
+		names[uint32(v)] = name
+	}
+	v, err := parseName(string(b), names)
+	*s = RstStreamStatus(v)
+	return err
+}
+
+func (s GoAwayStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *GoAwayStatus) UnmarshalText(b []byte) error {
+	names := make(map[uint32]string, len(goAwayStatusNames))
+	for v, name := range goAwayStatusNames {
+		names[uint32(v)] = name
+	}
+	v, err := parseName(string(b), names)
+	*s = GoAwayStatus(v)
+	return err
+}
+
+func (id SettingsId) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *SettingsId) UnmarshalText(b []byte) error {
+	names := make(map[uint32]string, len(settingsIdNames))
+	for v, name := range settingsIdNames {
+		names[uint32(v)] = name
+	}
+	v, err := parseName(string(b), names)
+	*id = SettingsId(v)
+	return err
+}
+
+// ReadTranscript reads a JSON transcript from r and returns its frames.
+func ReadTranscript(r io.Reader) ([]Frame, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	frames := make([]Frame, len(raw))
+	for i, b := range raw {
+		frame, err := UnmarshalFrame(b)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		frames[i] = frame
+	}
+	return frames, nil
+}
+
+// WriteTranscript writes frames to w as a JSON transcript with one frame
+// per line, which keeps golden files easy to diff.
+func WriteTranscript(w io.Writer, frames []Frame) error {
+	var buf bytes.Buffer
+	buf.WriteString("[\n")
+	for i, frame := range frames {
+		b, err := json.Marshal(frame)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		if i < len(frames)-1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("]\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// TranscriptToWire reads a JSON transcript from r and writes its frames to
+// w with a new Framer, so that header blocks share one compression context
+// as they would on a connection.
+func TranscriptToWire(w io.Writer, r io.Reader) error {
+	frames, err := ReadTranscript(r)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	framer, err := NewFramer(bw, nil)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// WireToTranscript decodes the SPDY byte stream read from r and writes its
+// frames to w as a JSON transcript. Frames are read in lenient mode, so that
+// violations of the spec that can be decoded past do not stop it; if
+// onWarning is not nil, it is called with each of them.
+func WireToTranscript(w io.Writer, r io.Reader, onWarning func(*Error)) error {
+	framer, err := NewFramer(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	framer.SetParseMode(ParseLenient)
+	framer.SetHooks(&FrameHooks{OnWarning: onWarning})
+	var frames []Frame
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		frames = append(frames, frame)
+	}
+	return WriteTranscript(w, frames)
+}
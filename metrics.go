@@ -0,0 +1,100 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"time"
+)
+
+// Metrics receives measurements from sessions. Implementations must be safe
+// for concurrent use, and should be quick: they are called from the
+// goroutines reading and writing frames.
+type Metrics interface {
+	// SessionOpened and SessionClosed are called as a session starts and
+	// ends.
+	SessionOpened()
+	SessionClosed()
+
+	// StreamOpened and StreamClosed are called as a stream is opened, by
+	// either end, and as it is forgotten: once both sides have closed, or
+	// it has been reset, or the session has ended.
+	StreamOpened()
+	StreamClosed()
+
+	// FrameRead and FrameWritten are called for every frame, with its type
+	// as the draft spells it, such as "SYN_STREAM" or "DATA", and its size
+	// on the wire.
+	FrameRead(frameType string, wireBytes int)
+	FrameWritten(frameType string, wireBytes int)
+
+	// HeadersCompressed is called for every header block, read or
+	// written, with its size before compression and on the wire.
+	HeadersCompressed(uncompressed, compressed int)
+
+	// StreamReset and GoAway are called for every RST_STREAM and GOAWAY
+	// frame, with remote set for those the peer sent.
+	StreamReset(status RstStreamStatus, remote bool)
+	GoAway(status GoAwayStatus, remote bool)
+
+	// PingRTT is called with the round trip time of every Session.Ping.
+	PingRTT(rtt time.Duration)
+
+	// FlowControlStall is called each time a stream's Write has waited
+	// for the peer to open its flow control window, with how long it
+	// waited.
+	FlowControlStall(d time.Duration)
+}
+
+// DefaultMetrics collects the metrics of sessions made by NewSession, and of
+// servers and transports whose Metrics field is nil. Importing package
+// expvarmetrics sets it to the expvar-backed default, published as "spdy";
+// it is left nil, collecting nothing, otherwise, so that this package does
+// not import expvar and publish /debug/vars on http.DefaultServeMux for
+// programs that do not ask for it.
+var DefaultMetrics Metrics
+
+// nopMetrics discards all measurements.
+type nopMetrics struct{}
+
+func (nopMetrics) SessionOpened()                    {}
+func (nopMetrics) SessionClosed()                    {}
+func (nopMetrics) StreamOpened()                     {}
+func (nopMetrics) StreamClosed()                     {}
+func (nopMetrics) FrameRead(string, int)             {}
+func (nopMetrics) FrameWritten(string, int)          {}
+func (nopMetrics) HeadersCompressed(int, int)        {}
+func (nopMetrics) StreamReset(RstStreamStatus, bool) {}
+func (nopMetrics) GoAway(GoAwayStatus, bool)         {}
+func (nopMetrics) PingRTT(time.Duration)             {}
+func (nopMetrics) FlowControlStall(time.Duration)    {}
+
+// frameTypeName returns the name of frame's type as the draft spells it.
+func frameTypeName(frame Frame) string {
+	if _, ok := frame.(*DataFrame); ok {
+		return "DATA"
+	}
+	if t := controlFrameType(frame); t != 0 {
+		return t.String()
+	}
+	return "UNKNOWN"
+}
+
+// metricsHooks returns frame hooks feeding m.
+func metricsHooks(m Metrics) *FrameHooks {
+	return &FrameHooks{
+		OnFrameRead: func(frame Frame, n int) {
+			m.FrameRead(frameTypeName(frame), n)
+		},
+		OnFrameWritten: func(frame Frame, n int) {
+			m.FrameWritten(frameTypeName(frame), n)
+		},
+		OnHeadersDecompressed: func(_ StreamId, compressed, decompressed int) {
+			m.HeadersCompressed(decompressed, compressed)
+		},
+		OnHeadersCompressed: func(_ StreamId, uncompressed, compressed int) {
+			m.HeadersCompressed(uncompressed, compressed)
+		},
+	}
+}
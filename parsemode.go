@@ -0,0 +1,66 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"fmt"
+)
+
+// ParseMode is how a Framer treats frames that break the spec in ways it
+// can still make sense of.
+type ParseMode int
+
+const (
+	// ParseStrict rejects every violation. Header names that are not
+	// lowercase or that repeat are stream errors, returned with the
+	// headers as read; control frames of a version other than 3, reserved
+	// bits that are set and flags that are not valid for the frame type
+	// are session errors.
+	ParseStrict ParseMode = iota
+
+	// ParseLenient tolerates those violations, common bugs in peers, and
+	// reports each of them to the OnWarning hook instead. Header names are
+	// taken whatever their case and the values of repeated names merged,
+	// frames of other versions are read as version 3, reserved bits are
+	// cleared and unknown flags are ignored.
+	ParseLenient
+)
+
+func (m ParseMode) String() string {
+	switch m {
+	case ParseStrict:
+		return "ParseStrict"
+	case ParseLenient:
+		return "ParseLenient"
+	}
+	return fmt.Sprintf("ParseMode(%d)", int(m))
+}
+
+// SetParseMode sets how f reads frames. A new Framer is strict.
+func (f *Framer) SetParseMode(mode ParseMode) {
+	f.parseMode = mode
+}
+
+// violation handles e, a breach of the spec in a frame that could still be
+// decoded. In strict mode it is returned as the error; in lenient mode it is
+// passed to the OnWarning hook and nil is returned.
+func (f *Framer) violation(e *Error) error {
+	if f.parseMode == ParseStrict {
+		return e
+	}
+	if f.hooks != nil && f.hooks.OnWarning != nil {
+		f.hooks.OnWarning(e)
+	}
+	return nil
+}
+
+// reservedBits reports bits, the reserved bits of a frame that were set,
+// as a violation if there are any.
+func (f *Framer) reservedBits(frameType ControlFrameType, streamId StreamId, bits uint32) error {
+	if bits == 0 {
+		return nil
+	}
+	return f.violation(&Error{Err: ReservedBitSet, StreamId: streamId, FrameType: frameType})
+}
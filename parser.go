@@ -0,0 +1,102 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"errors"
+	"io"
+)
+
+// Parser decodes frames from chunks of input as they arrive, for event
+// loops that cannot block in ReadFrame. Chunks may split frames anywhere;
+// the header decompression context carries over from one to the next.
+type Parser struct {
+	framer  *Framer
+	onFrame func(Frame) error
+	buf     []byte  // input not yet decoded
+	queue   []Frame // decoded frames not yet taken by Next
+	err     error
+}
+
+// NewParser returns a Parser that passes each frame, as it is completed, to
+// onFrame. If onFrame is nil, frames are queued for Next instead.
+func NewParser(onFrame func(Frame) error) (*Parser, error) {
+	framer, err := NewFramer(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Parser{framer: framer, onFrame: onFrame}, nil
+}
+
+// SetHooks installs hooks on the parser's Framer.
+func (p *Parser) SetHooks(hooks *FrameHooks) {
+	p.framer.SetHooks(hooks)
+}
+
+// Feed decodes the frames that b completes. Frames do not refer to b, which
+// the caller may reuse once Feed returns. An error from onFrame, or a stream
+// error in a frame, stops Feed and is returned, with the rest of b kept for
+// the next call. Any other error leaves the input or the header
+// decompression context in doubt, so after it every call fails.
+func (p *Parser) Feed(b []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	// Decode straight from b when nothing is held back, and keep only
+	// the partial frame at its end.
+	input := b
+	if len(p.buf) > 0 {
+		p.buf = append(p.buf, b...)
+		input = p.buf
+	}
+	off := 0
+	var err error
+	for err == nil {
+		var frame Frame
+		var n int
+		frame, n, err = p.framer.ParseFrame(input[off:])
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+			break
+		}
+		off += n
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) || e.Scope == ScopeSession {
+				p.err = err
+			}
+			break
+		}
+		if p.onFrame != nil {
+			err = p.onFrame(frame)
+		} else {
+			p.queue = append(p.queue, frame)
+		}
+	}
+	rest := input[off:]
+	if len(p.buf) > 0 {
+		p.buf = p.buf[:copy(p.buf, rest)]
+	} else {
+		p.buf = append(p.buf, rest...)
+	}
+	return err
+}
+
+// Next returns the oldest queued frame, reporting false if there is none.
+func (p *Parser) Next() (Frame, bool) {
+	if len(p.queue) == 0 {
+		return nil, false
+	}
+	frame := p.queue[0]
+	p.queue[0] = nil
+	p.queue = p.queue[1:]
+	return frame, true
+}
+
+// Buffered returns the number of bytes held back as the start of a frame
+// not yet complete.
+func (p *Parser) Buffered() int {
+	return len(p.buf)
+}
@@ -5,9 +5,12 @@
 package spdy
 
 import (
+	"compress/flate"
 	"compress/zlib"
 	"encoding/binary"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -22,70 +25,76 @@ func (frame *SynReplyFrame) read(h ControlFrameHeader, f *Framer) error {
 
 func (frame *RstStreamFrame) read(h ControlFrameHeader, f *Framer) error {
 	frame.CFHeader = h
-	if err := binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
-		return err
-	}
-	if err := binary.Read(f.r, binary.BigEndian, &frame.Status); err != nil {
+	b, err := f.readScratch(8)
+	if err != nil {
 		return err
 	}
+	id := binary.BigEndian.Uint32(b)
+	frame.StreamId = StreamId(id & 0x7fffffff)
+	frame.Status = RstStreamStatus(binary.BigEndian.Uint32(b[4:]))
 	if frame.Status == 0 {
-		return &Error{InvalidControlFrame, frame.StreamId}
+		return &Error{Err: InvalidControlFrame, StreamId: frame.StreamId}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
-	return nil
+	return f.reservedBits(TypeRstStream, frame.StreamId, id&0x80000000)
 }
 
 func (frame *SettingsFrame) read(h ControlFrameHeader, f *Framer) error {
 	frame.CFHeader = h
-	var numSettings uint32
-	if err := binary.Read(f.r, binary.BigEndian, &numSettings); err != nil {
+	numSettings, err := f.readUint32()
+	if err != nil {
 		return err
 	}
+	if numSettings > (h.length-4)/8 {
+		return &Error{Err: InvalidFrameLength}
+	}
 	frame.FlagIdValues = make([]SettingsFlagIdValue, numSettings)
-	for i := uint32(0); i < numSettings; i++ {
-		if err := binary.Read(f.r, binary.BigEndian, &frame.FlagIdValues[i].Id); err != nil {
-			return err
-		}
-		frame.FlagIdValues[i].Flag = SettingsFlag((frame.FlagIdValues[i].Id & 0xff000000) >> 24)
-		frame.FlagIdValues[i].Id &= 0xffffff
-		if err := binary.Read(f.r, binary.BigEndian, &frame.FlagIdValues[i].Value); err != nil {
+	var badFlags bool
+	for i := range frame.FlagIdValues {
+		b, err := f.readScratch(8)
+		if err != nil {
 			return err
 		}
+		flagId := binary.BigEndian.Uint32(b)
+		frame.FlagIdValues[i].Flag = SettingsFlag(flagId >> 24)
+		frame.FlagIdValues[i].Id = SettingsId(flagId & 0xffffff)
+		frame.FlagIdValues[i].Value = binary.BigEndian.Uint32(b[4:])
+		badFlags = badFlags || frame.FlagIdValues[i].Flag&^(FlagSettingsPersistValue|FlagSettingsPersisted) != 0
+	}
+	if badFlags {
+		return f.violation(&Error{Err: InvalidFlags, FrameType: TypeSettings})
 	}
 	return nil
 }
 
 func (frame *PingFrame) read(h ControlFrameHeader, f *Framer) error {
 	frame.CFHeader = h
-	if err := binary.Read(f.r, binary.BigEndian, &frame.Id); err != nil {
+	id, err := f.readUint32()
+	if err != nil {
 		return err
 	}
+	frame.Id = id
 	if frame.Id == 0 {
-		return &Error{ZeroStreamId, 0}
-	}
-	if frame.CFHeader.Flags != 0 {
-		return &Error{InvalidControlFrame, StreamId(frame.Id)}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	return nil
 }
 
 func (frame *GoAwayFrame) read(h ControlFrameHeader, f *Framer) error {
 	frame.CFHeader = h
-	if err := binary.Read(f.r, binary.BigEndian, &frame.LastGoodStreamId); err != nil {
+	id, err := f.readUint32()
+	if err != nil {
 		return err
 	}
-	if frame.CFHeader.Flags != 0 {
-		return &Error{InvalidControlFrame, frame.LastGoodStreamId}
-	}
-	if frame.CFHeader.length != 8 {
-		return &Error{InvalidControlFrame, frame.LastGoodStreamId}
-	}
-	if err := binary.Read(f.r, binary.BigEndian, &frame.Status); err != nil {
+	frame.LastGoodStreamId = StreamId(id & 0x7fffffff)
+	status, err := f.readUint32()
+	if err != nil {
 		return err
 	}
-	return nil
+	frame.Status = GoAwayStatus(status)
+	return f.reservedBits(TypeGoAway, 0, id&0x80000000)
 }
 
 func (frame *HeadersFrame) read(h ControlFrameHeader, f *Framer) error {
@@ -94,29 +103,45 @@ func (frame *HeadersFrame) read(h ControlFrameHeader, f *Framer) error {
 
 func (frame *WindowUpdateFrame) read(h ControlFrameHeader, f *Framer) error {
 	frame.CFHeader = h
-	if err := binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
+	id, err := f.readUint32()
+	if err != nil {
 		return err
 	}
-	if frame.CFHeader.Flags != 0 {
-		return &Error{InvalidControlFrame, frame.StreamId}
-	}
-	if frame.CFHeader.length != 8 {
-		return &Error{InvalidControlFrame, frame.StreamId}
-	}
-	if err := binary.Read(f.r, binary.BigEndian, &frame.DeltaWindowSize); err != nil {
+	frame.StreamId = StreamId(id & 0x7fffffff)
+	delta, err := f.readUint32()
+	if err != nil {
 		return err
 	}
-	return nil
+	frame.DeltaWindowSize = delta & 0x7fffffff
+	return f.reservedBits(TypeWindowUpdate, frame.StreamId, (id|delta)&0x80000000)
 }
 
 func newControlFrame(frameType ControlFrameType) (controlFrame, error) {
 	ctor, ok := cframeCtor[frameType]
 	if !ok {
-		return nil, &Error{Err: InvalidControlFrame}
+		return nil, &Error{Err: InvalidControlFrame, FrameType: frameType}
 	}
 	return ctor(), nil
 }
 
+// controlFrameRules holds, for each type of control frame, the flags it may
+// carry and the length of its fixed fields. Frames that end in a header
+// block or a list of settings are longer; the rest are exactly that long,
+// which parseControlFrame checks once the fields are read.
+var controlFrameRules = map[ControlFrameType]struct {
+	flags  ControlFlags
+	length uint32
+}{
+	TypeSynStream:    {ControlFlagFin | ControlFlagUnidirectional, 10},
+	TypeSynReply:     {ControlFlagFin, 4},
+	TypeRstStream:    {0, 8},
+	TypeSettings:     {ControlFlagSettingsClearSettings, 4},
+	TypePing:         {0, 4},
+	TypeGoAway:       {0, 8},
+	TypeHeaders:      {ControlFlagFin, 4},
+	TypeWindowUpdate: {0, 8},
+}
+
 var cframeCtor = map[ControlFrameType]func() controlFrame{
 	TypeSynStream:    func() controlFrame { return new(SynStreamFrame) },
 	TypeSynReply:     func() controlFrame { return new(SynReplyFrame) },
@@ -130,6 +155,8 @@ var cframeCtor = map[ControlFrameType]func() controlFrame{
 
 func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
 	if f.headerDecompressor != nil {
+		// f.r is not always the same reader: ParseFrame swaps it.
+		f.headerReader.R = f.r
 		f.headerReader.N = payloadSize
 		return nil
 	}
@@ -143,64 +170,306 @@ func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
 }
 
 // ReadFrame reads SPDY encoded data and returns a decompressed Frame.
+// WireSize reports how many bytes it took on the wire. It returns io.EOF if
+// the input ends before a frame starts; input that ends within a frame, or
+// fails to be read, gives an *Error with code ReadFailed wrapping the cause.
 func (f *Framer) ReadFrame() (Frame, error) {
-	var firstWord uint32
-	if err := binary.Read(f.r, binary.BigEndian, &firstWord); err != nil {
+	frame, err := f.readFrame()
+	if f.hooks != nil {
+		f.hooks.frameRead(frame, err)
+	}
+	return frame, err
+}
+
+// ParseFrame decodes the frame at the start of b and returns it with the
+// number of bytes it took. Header blocks are decompressed in the same
+// context as ReadFrame's, so frames may be read either way, in any mix, in
+// the order they were sent. If b does not yet hold a whole frame, ParseFrame
+// returns io.ErrUnexpectedEOF and consumes nothing. A frame that is whole
+// but malformed is still consumed.
+func (f *Framer) ParseFrame(b []byte) (Frame, int, error) {
+	if len(b) < 8 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := 8 + int(binary.BigEndian.Uint32(b[4:])&0xffffff)
+	if len(b) < n {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	r := f.r
+	f.parseBuf.Reset(b[:n])
+	f.r = &f.parseBuf
+	frame, err := f.ReadFrame()
+	f.r = r
+	f.parseBuf.Reset(nil)
+	return frame, n, err
+}
+
+// ReadFrameHeader reads the header of the next frame, leaving the rest of
+// it, h.BodyLength() bytes, to be decoded with ReadFrameBody or passed on
+// unread, for instance with io.CopyN from the reader the Framer was made
+// with. Header blocks are compressed in one context for the whole
+// connection, so once a frame carrying one has been passed on unread,
+// later ones cannot be decoded. A control frame too short to hold the stream
+// ID its type calls for is consumed whole and reported as an InvalidFrameLength
+// error, with the next frame left to be read.
+func (f *Framer) ReadFrameHeader() (FrameHeader, error) {
+	var h FrameHeader
+	b, err := f.readScratch(8)
+	if err == io.EOF {
+		return h, err
+	}
+	if err != nil {
+		return h, readFailed(err)
+	}
+	firstWord := binary.BigEndian.Uint32(b)
+	h.Flags = b[4]
+	h.Length = binary.BigEndian.Uint32(b[4:]) & 0xffffff
+	if firstWord&0x80000000 == 0 {
+		h.StreamId = StreamId(firstWord & 0x7fffffff)
+		return h, nil
+	}
+	h.Control = true
+	h.Version = uint16(firstWord >> 16 & 0x7fff)
+	h.Type = ControlFrameType(firstWord & 0xffff)
+	switch h.Type {
+	case TypeSynStream, TypeSynReply, TypeRstStream, TypeHeaders, TypeWindowUpdate:
+		if h.Length < 4 {
+			// Too short to hold the stream ID: consume what there is,
+			// so that the next frame can still be read.
+			if _, err := io.CopyN(ioutil.Discard, f.r, int64(h.Length)); err != nil {
+				return h, readFailed(err)
+			}
+			h.read = int(h.Length)
+			return h, &Error{Err: InvalidFrameLength, FrameType: h.Type}
+		}
+		id, err := f.readUint32()
+		if err != nil {
+			return h, readFailed(err)
+		}
+		h.StreamId = StreamId(id & 0x7fffffff)
+		h.read = 4
+	}
+	return h, nil
+}
+
+// BodyLength returns the number of bytes of the frame left after its
+// header.
+func (h *FrameHeader) BodyLength() int {
+	return int(h.Length) - h.read
+}
+
+// Append appends to dst the bytes of the frame that ReadFrameHeader read, so
+// that a frame can be passed on by writing them followed by the rest of
+// the frame.
+func (h *FrameHeader) Append(dst []byte) []byte {
+	var b [12]byte
+	if h.Control {
+		putControlFrameHeader(b[:], ControlFrameHeader{h.Version, h.Type, ControlFlags(h.Flags), h.Length})
+		binary.BigEndian.PutUint32(b[8:], uint32(h.StreamId))
+	} else {
+		binary.BigEndian.PutUint32(b[:], uint32(h.StreamId))
+		binary.BigEndian.PutUint32(b[4:], uint32(h.Flags)<<24|h.Length)
+	}
+	return append(dst, b[:8+h.read]...)
+}
+
+// ReadFrameBody decodes the rest of the frame whose header ReadFrameHeader
+// has just returned as h, as ReadFrame would have decoded the whole.
+func (f *Framer) ReadFrameBody(h FrameHeader) (Frame, error) {
+	var frame Frame
+	var err error
+	if h.Control {
+		r := f.r
+		binary.BigEndian.PutUint32(f.bodyBuf.prefix[:], uint32(h.StreamId))
+		f.bodyBuf.b = f.bodyBuf.prefix[:h.read]
+		f.bodyBuf.r = r
+		f.r = &f.bodyBuf
+		frame, err = f.parseControlFrame(h.Version, h.Type, uint32(h.Flags)<<24|h.Length)
+		f.r = r
+		f.bodyBuf.r = nil
+	} else {
+		var data *DataFrame
+		if data, err = f.parseDataFrame(h.StreamId, uint32(h.Flags)<<24|h.Length); err == nil {
+			frame = data
+		}
+	}
+	if f.hooks != nil {
+		f.hooks.frameRead(frame, err)
+	}
+	return frame, err
+}
+
+// prefixReader reads b and then r.
+type prefixReader struct {
+	prefix [4]byte
+	b      []byte
+	r      io.Reader
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if len(p.b) > 0 {
+		n := copy(b, p.b)
+		p.b = p.b[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+// readScratch reads the next n bytes, at most len(f.rbuf), into the
+// framer's scratch buffer. The result is valid until the next read.
+func (f *Framer) readScratch(n int) ([]byte, error) {
+	b := f.rbuf[:n]
+	if _, err := io.ReadFull(f.r, b); err != nil {
 		return nil, err
 	}
+	return b, nil
+}
+
+func (f *Framer) readUint32() (uint32, error) {
+	b, err := f.readScratch(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (f *Framer) readFrame() (Frame, error) {
+	b, err := f.readScratch(8)
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, readFailed(err)
+	}
+	firstWord := binary.BigEndian.Uint32(b)
+	length := binary.BigEndian.Uint32(b[4:])
 	if firstWord&0x80000000 != 0 {
 		frameType := ControlFrameType(firstWord & 0xffff)
 		version := uint16(firstWord >> 16 & 0x7fff)
-		return f.parseControlFrame(version, frameType)
+		return f.parseControlFrame(version, frameType, length)
 	}
-	return f.parseDataFrame(StreamId(firstWord & 0x7fffffff))
+	return f.parseDataFrame(StreamId(firstWord&0x7fffffff), length)
 }
 
-func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (Frame, error) {
-	var length uint32
-	if err := binary.Read(f.r, binary.BigEndian, &length); err != nil {
-		return nil, err
-	}
+// parseControlFrame reads the payload of a control frame. Whether or not it
+// is well formed, the whole payload is consumed, so that the next frame can
+// be read, unless reading the connection fails.
+func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType, length uint32) (Frame, error) {
 	flags := ControlFlags((length & 0xff000000) >> 24)
 	length &= 0xffffff
 	header := ControlFrameHeader{version, frameType, flags, length}
-	cframe, err := newControlFrame(frameType)
+	r := f.r
+	f.frameReader = io.LimitedReader{R: r, N: int64(length)}
+	f.r = &f.frameReader
+	cframe, err := f.readControlFrame(header)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && f.frameReader.N == 0 {
+		// The fields ran past the end of the frame.
+		err = &Error{Err: InvalidFrameLength}
+	}
+	if err == nil && f.frameReader.N > 0 {
+		// Bytes were left over after the fields.
+		err = f.violation(&Error{Err: InvalidFrameLength, FrameType: frameType})
+	}
+	if _, ok := err.(*Error); (err == nil || ok) && f.frameReader.N > 0 {
+		if _, derr := io.CopyN(ioutil.Discard, &f.frameReader, f.frameReader.N); err == nil {
+			err = derr
+		}
+	}
+	f.r = r
+	if err != nil {
+		err = readFailed(err)
+		if e, ok := err.(*Error); ok && e.FrameType == 0 {
+			e.FrameType = frameType
+		}
+		return nil, err
+	}
+	return cframe, nil
+}
+
+// readControlFrame reads the fields of the control frame with header h and
+// checks its version, and its flags and least length against the rules for
+// its type.
+func (f *Framer) readControlFrame(h ControlFrameHeader) (controlFrame, error) {
+	if h.version != Version {
+		if err := f.violation(&Error{Err: UnsupportedFrameVersion, FrameType: h.frameType}); err != nil {
+			return nil, err
+		}
+	}
+	cframe, err := newControlFrame(h.frameType)
 	if err != nil {
 		return nil, err
 	}
-	if err = cframe.read(header, f); err != nil {
+	rules := controlFrameRules[h.frameType]
+	if h.length < rules.length {
+		return nil, &Error{Err: InvalidFrameLength}
+	}
+	if err = cframe.read(h, f); err != nil {
 		return nil, err
 	}
+	if h.Flags&^rules.flags != 0 {
+		if err := f.violation(&Error{Err: InvalidFlags, FrameType: h.frameType}); err != nil {
+			return nil, err
+		}
+	}
 	return cframe, nil
 }
 
-func parseHeaderValueBlock(r io.Reader, streamId StreamId) (http.Header, error) {
-	var numHeaders uint32
-	if err := binary.Read(r, binary.BigEndian, &numHeaders); err != nil {
+// parseHeaderValueBlock reads an uncompressed header block. Names that are
+// not lowercase or that repeat are violations: in strict mode the first is
+// returned, once the whole block has been read, along with the headers.
+func (f *Framer) parseHeaderValueBlock(r io.Reader, frameType ControlFrameType, streamId StreamId) (http.Header, error) {
+	var scratch [4]byte
+	readUint32 := func() (uint32, error) {
+		if _, err := io.ReadFull(r, scratch[:]); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint32(scratch[:]), nil
+	}
+	tooLarge := &Error{Err: HeaderBlockTooLarge, StreamId: streamId, FrameType: frameType}
+	numHeaders, err := readUint32()
+	if err != nil {
 		return nil, err
 	}
+	// Each header takes 8 bytes for its lengths, whatever its size.
+	budget := uint32(maxHeaderBlockSize)
+	if numHeaders > budget/8 {
+		return nil, tooLarge
+	}
+	budget -= 8 * numHeaders
 	var e error
 	h := make(http.Header, int(numHeaders))
 	for i := 0; i < int(numHeaders); i++ {
-		var length uint32
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		length, err := readUint32()
+		if err != nil {
 			return nil, err
 		}
+		if length > budget {
+			return nil, tooLarge
+		}
+		budget -= length
 		nameBytes := make([]byte, length)
 		if _, err := io.ReadFull(r, nameBytes); err != nil {
 			return nil, err
 		}
 		name := string(nameBytes)
 		if name != strings.ToLower(name) {
-			e = &Error{UnlowercasedHeaderName, streamId}
+			if err := f.violation(&Error{Err: UnlowercasedHeaderName, StreamId: streamId, FrameType: frameType, Scope: ScopeStream}); e == nil {
+				e = err
+			}
 			name = strings.ToLower(name)
 		}
-		if h[name] != nil {
-			e = &Error{DuplicateHeaders, streamId}
+		if h[http.CanonicalHeaderKey(name)] != nil {
+			if err := f.violation(&Error{Err: DuplicateHeaders, StreamId: streamId, FrameType: frameType, Scope: ScopeStream}); e == nil {
+				e = err
+			}
 		}
-		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		if length, err = readUint32(); err != nil {
 			return nil, err
 		}
+		if length > budget {
+			return nil, tooLarge
+		}
+		budget -= length
 		value := make([]byte, length)
 		if _, err := io.ReadFull(r, value); err != nil {
 			return nil, err
@@ -216,98 +485,136 @@ func parseHeaderValueBlock(r io.Reader, streamId StreamId) (http.Header, error)
 	return h, nil
 }
 
-func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame) error {
-	frame.CFHeader = h
-	var err error
-	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
-		return err
-	}
-	if err = binary.Read(f.r, binary.BigEndian, &frame.AssociatedToStreamId); err != nil {
-		return err
-	}
-	if err = binary.Read(f.r, binary.BigEndian, &frame.Priority); err != nil {
-		return err
-	}
-	frame.Priority >>= 5
-	if err = binary.Read(f.r, binary.BigEndian, &frame.Slot); err != nil {
-		return err
-	}
+// readHeaderBlock reads the header block that ends a control frame, taking
+// up payloadSize bytes on the wire.
+func (f *Framer) readHeaderBlock(frameType ControlFrameType, streamId StreamId, payloadSize int64) (http.Header, error) {
 	reader := f.r
 	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 10))
+		err := f.uncorkHeaderDecompressor(payloadSize)
+		if isDecompressionError(err) {
+			return nil, corruptHeaderBlock(streamId, err)
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		reader = f.headerDecompressor
 	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
+	var counter *countingReader
+	if f.hooks != nil && f.hooks.OnHeadersDecompressed != nil {
+		counter = &countingReader{r: reader}
+		reader = counter
+	}
+	h, err := f.parseHeaderValueBlock(reader, frameType, streamId)
+	if !f.headerCompressionDisabled {
+		if isDecompressionError(err) {
+			err = corruptHeaderBlock(streamId, err)
+		} else if errors.Is(err, ErrHeaderBlockTooLarge) {
+			// The rest of the block is left unread.
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF || f.headerReader.N != 0 {
+			e := &Error{Err: WrongCompressedPayloadSize, StreamId: streamId}
+			if _, ok := err.(*Error); !ok {
+				e.Cause = err
+			}
+			err = e
+		}
+	}
+	if counter != nil && h != nil {
+		f.hooks.OnHeadersDecompressed(streamId, int(payloadSize), counter.n)
+	}
+	return h, err
+}
+
+// readFailed wraps err, met reading a frame, as an *Error unless it is one
+// already. Only the first byte of a frame may meet a clean io.EOF; past it,
+// the frame was cut short.
+func readFailed(err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &Error{Err: ReadFailed, Cause: err}
+}
+
+// corruptHeaderBlock wraps err, met while decompressing the header block of
+// stream streamId. It is a session error: the decompression context is
+// shared by every stream, so it cannot be trusted afterwards.
+func corruptHeaderBlock(streamId StreamId, err error) *Error {
+	return &Error{Err: CorruptHeaderBlock, StreamId: streamId, Cause: err}
+}
+
+// isDecompressionError reports whether err came from a header block that
+// failed to decompress, which SPDY/3 makes a session error.
+func isDecompressionError(err error) bool {
+	switch err {
+	case zlib.ErrHeader, zlib.ErrDictionary, zlib.ErrChecksum:
+		return true
+	}
+	_, ok := err.(flate.CorruptInputError)
+	return ok
+}
+
+func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame) error {
+	frame.CFHeader = h
+	b, err := f.readScratch(8)
+	if err != nil {
+		return err
+	}
+	id, assoc := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+	frame.StreamId = StreamId(id & 0x7fffffff)
+	frame.AssociatedToStreamId = StreamId(assoc & 0x7fffffff)
+	if b, err = f.readScratch(2); err != nil {
+		return err
 	}
+	reserved := (id|assoc)&0x80000000 | uint32(b[0]&0x1f)
+	frame.Priority = b[0] >> 5
+	frame.Slot = b[1]
+	frame.Headers, err = f.readHeaderBlock(TypeSynStream, frame.StreamId, int64(h.length-10))
 	if err != nil {
 		return err
 	}
 	for h := range frame.Headers {
 		if invalidReqHeaders[h] {
-			return &Error{InvalidHeaderPresent, frame.StreamId}
+			return &Error{Err: InvalidHeaderPresent, StreamId: frame.StreamId, Scope: ScopeStream}
 		}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
-	return nil
+	return f.reservedBits(TypeSynStream, frame.StreamId, reserved)
 }
 
 func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) error {
 	frame.CFHeader = h
-	var err error
-	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
+	id, err := f.readUint32()
+	if err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 4))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
+	frame.StreamId = StreamId(id & 0x7fffffff)
+	frame.Headers, err = f.readHeaderBlock(TypeSynReply, frame.StreamId, int64(h.length-4))
 	if err != nil {
 		return err
 	}
 	for h := range frame.Headers {
 		if invalidRespHeaders[h] {
-			return &Error{InvalidHeaderPresent, frame.StreamId}
+			return &Error{Err: InvalidHeaderPresent, StreamId: frame.StreamId, Scope: ScopeStream}
 		}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
-	return nil
+	return f.reservedBits(TypeSynReply, frame.StreamId, id&0x80000000)
 }
 
 func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) error {
 	frame.CFHeader = h
-	var err error
-	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
+	id, err := f.readUint32()
+	if err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 4))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
+	frame.StreamId = StreamId(id & 0x7fffffff)
+	frame.Headers, err = f.readHeaderBlock(TypeHeaders, frame.StreamId, int64(h.length-4))
 	if err != nil {
 		return err
 	}
@@ -319,30 +626,32 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	}
 	for h := range frame.Headers {
 		if invalidHeaders[h] {
-			return &Error{InvalidHeaderPresent, frame.StreamId}
+			return &Error{Err: InvalidHeaderPresent, StreamId: frame.StreamId, Scope: ScopeStream}
 		}
 	}
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
-	return nil
+	return f.reservedBits(TypeHeaders, frame.StreamId, id&0x80000000)
 }
 
-func (f *Framer) parseDataFrame(streamId StreamId) (*DataFrame, error) {
-	var length uint32
-	if err := binary.Read(f.r, binary.BigEndian, &length); err != nil {
-		return nil, err
-	}
+func (f *Framer) parseDataFrame(streamId StreamId, length uint32) (*DataFrame, error) {
 	var frame DataFrame
 	frame.StreamId = streamId
 	frame.Flags = DataFlags(length >> 24)
 	length &= 0xffffff
 	frame.Data = make([]byte, length)
 	if _, err := io.ReadFull(f.r, frame.Data); err != nil {
-		return nil, err
+		return nil, readFailed(err)
 	}
 	if frame.StreamId == 0 {
-		return nil, &Error{ZeroStreamId, 0}
+		// The frame was read in full, so only it is lost.
+		return nil, &Error{Err: ZeroStreamId, StreamId: 0, Scope: ScopeStream}
+	}
+	if frame.Flags&^DataFlagFin != 0 {
+		if err := f.violation(&Error{Err: InvalidFlags, StreamId: frame.StreamId}); err != nil {
+			return nil, err
+		}
 	}
 	return &frame, nil
 }
@@ -0,0 +1,336 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// A RecordEntry is one frame of a recording.
+type RecordEntry struct {
+	// Time is when the frame was seen, relative to the start of the
+	// recording.
+	Time time.Duration
+
+	// Sent is set for frames the recorded endpoint wrote, and clear for
+	// frames it read.
+	Sent bool
+
+	Frame Frame
+}
+
+// recordEntryJSON is the schema of one line of a recording. Time is in
+// seconds.
+type recordEntryJSON struct {
+	Time  float64         `json:"time"`
+	Dir   string          `json:"dir"`
+	Frame json.RawMessage `json:"frame"`
+}
+
+func (e RecordEntry) MarshalJSON() ([]byte, error) {
+	frame, err := json.Marshal(e.Frame)
+	if err != nil {
+		return nil, err
+	}
+	dir := "recv"
+	if e.Sent {
+		dir = "send"
+	}
+	return json.Marshal(recordEntryJSON{e.Time.Seconds(), dir, frame})
+}
+
+func (e *RecordEntry) UnmarshalJSON(b []byte) error {
+	var v recordEntryJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Dir != "send" && v.Dir != "recv" {
+		return fmt.Errorf("unknown direction %q", v.Dir)
+	}
+	frame, err := UnmarshalFrame(v.Frame)
+	if err != nil {
+		return err
+	}
+	*e = RecordEntry{
+		Time:  time.Duration(v.Time * float64(time.Second)),
+		Sent:  v.Dir == "send",
+		Frame: frame,
+	}
+	return nil
+}
+
+// A Recorder logs frames to a writer as JSON lines, one RecordEntry per
+// line, for ReadRecording and Replayer to load again. It is safe for
+// concurrent use.
+type Recorder struct {
+	mu        sync.Mutex
+	w         io.Writer
+	start     time.Time
+	err       error
+	decodeErr error
+	warnings  []*Error
+}
+
+// NewRecorder returns a Recorder writing to w. Entry times are relative to
+// the call to NewRecorder.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, start: time.Now()}
+}
+
+// Err returns the first error writing the recording or, failing that, the
+// first error decoding the frames passing through a Conn, if any. Frames
+// seen after a write error are dropped, as are those in the same direction
+// after a decode error.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.decodeErr
+}
+
+// Warnings returns the violations of the spec seen in the frames recorded,
+// which are decoded leniently by Conn, and by the Framers using Hooks if
+// they are set to be.
+func (r *Recorder) Warnings() []*Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Error(nil), r.warnings...)
+}
+
+func (r *Recorder) warn(e *Error) {
+	r.mu.Lock()
+	r.warnings = append(r.warnings, e)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) decodeFailed(err error) {
+	r.mu.Lock()
+	if r.decodeErr == nil {
+		r.decodeErr = err
+	}
+	r.mu.Unlock()
+}
+
+func (r *Recorder) record(frame Frame, sent bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	b, err := json.Marshal(RecordEntry{time.Since(r.start), sent, frame})
+	if err == nil {
+		_, err = r.w.Write(append(b, '\n'))
+	}
+	r.err = err
+}
+
+// Hooks returns hooks that record the frames a Framer reads and writes, for
+// code that drives a Framer itself.
+func (r *Recorder) Hooks() *FrameHooks {
+	return &FrameHooks{
+		OnFrameRead:    func(frame Frame, _ int) { r.record(frame, false) },
+		OnFrameWritten: func(frame Frame, _ int) { r.record(frame, true) },
+		OnWarning:      r.warn,
+	}
+}
+
+// Conn returns a connection that passes everything through to c and
+// records the frames read from and written to it, for use with NewSession
+// or Server.ServeConn. Each direction is decoded by a lenient Framer of its
+// own as soon as a whole frame has passed, so that frames breaking the spec
+// in ways the endpoints may tolerate are still recorded. Outgoing frames are
+// recorded just before they are written, so that they precede any answer to
+// them.
+func (r *Recorder) Conn(c net.Conn) net.Conn {
+	hooks := func(sent bool) *FrameHooks {
+		return &FrameHooks{
+			OnFrameRead: func(frame Frame, _ int) { r.record(frame, sent) },
+			OnWarning:   r.warn,
+		}
+	}
+	return &recordConn{
+		Conn: c,
+		in:   newFrameTap(hooks(false), r.decodeFailed),
+		out:  newFrameTap(hooks(true), r.decodeFailed),
+	}
+}
+
+type recordConn struct {
+	net.Conn
+	in, out *frameTap
+}
+
+func (c *recordConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.write(p[:n])
+	return n, err
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.out.write(p)
+	return c.Conn.Write(p)
+}
+
+// frameTap decodes the bytes written to it as a stream of frames, in
+// lenient mode, calling hooks as its Framer reads them. Once it fails to
+// decode a frame it passes the error to fail and ignores the rest.
+type frameTap struct {
+	mu      sync.Mutex
+	pending bytes.Buffer // the start of a frame not yet complete
+	frames  bytes.Buffer // whole frames, which framer reads
+	framer  *Framer
+	fail    func(error)
+	failed  bool
+}
+
+func newFrameTap(hooks *FrameHooks, fail func(error)) *frameTap {
+	t := &frameTap{fail: fail}
+	framer, err := NewFramer(ioutil.Discard, &t.frames)
+	if err != nil {
+		t.failed = true
+		fail(err)
+		return t
+	}
+	framer.SetParseMode(ParseLenient)
+	framer.SetHooks(hooks)
+	t.framer = framer
+	return t
+}
+
+func (t *frameTap) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failed {
+		return
+	}
+	t.pending.Write(p)
+	for t.pending.Len() >= 8 {
+		b := t.pending.Bytes()
+		// Control and data frames both end their 8-byte header with a
+		// 24-bit length.
+		n := 8 + (int(b[5])<<16 | int(b[6])<<8 | int(b[7]))
+		if len(b) < n {
+			break
+		}
+		t.frames.Write(t.pending.Next(n))
+		_, err := t.framer.ReadFrame()
+		if err == nil && t.frames.Len() != 0 {
+			err = &Error{Err: InvalidFrameLength}
+		}
+		if err != nil {
+			t.failed = true
+			t.pending.Reset()
+			t.fail(err)
+			return
+		}
+	}
+}
+
+// ReadRecording reads the recording written by a Recorder from r.
+func ReadRecording(r io.Reader) ([]RecordEntry, error) {
+	var entries []RecordEntry
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var e RecordEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// A Replayer plays the peer of a recorded endpoint: it sends the frames the
+// endpoint received, and checks that the endpoint under test sends the
+// frames it sent, in the recorded order. Recording a client and replaying
+// against a new client thus stands in for the server, and the other way
+// round.
+type Replayer struct {
+	// Entries is the recording to play.
+	Entries []RecordEntry
+
+	// Equal reports whether got, sent by the endpoint under test, is
+	// equivalent to the recorded frame want. If nil, frames are equivalent
+	// when their JSON encodings are equal, which leaves out lengths.
+	Equal func(want, got Frame) bool
+
+	// Timeout, if non-zero, limits the wait for each frame from the
+	// endpoint under test.
+	Timeout time.Duration
+
+	// Realtime makes the replayer wait before sending each frame until as
+	// much time has passed as in the recording.
+	Realtime bool
+}
+
+// Replay plays the recording on c, the connection to the endpoint under
+// test. It returns an error describing the first difference, or nil once
+// every entry has been played. It does not close c.
+func (p *Replayer) Replay(c net.Conn) error {
+	bw := bufio.NewWriter(c)
+	framer, err := NewFramer(bw, bufio.NewReader(c))
+	if err != nil {
+		return err
+	}
+	equal := p.Equal
+	if equal == nil {
+		equal = jsonEqual
+	}
+	start := time.Now()
+	for i, e := range p.Entries {
+		if !e.Sent {
+			if p.Realtime {
+				time.Sleep(e.Time - time.Since(start))
+			}
+			if err := framer.WriteFrame(e.Frame); err != nil {
+				return fmt.Errorf("entry %d: sending %v: %v", i, e.Frame, err)
+			}
+			if err := bw.Flush(); err != nil {
+				return fmt.Errorf("entry %d: sending %v: %v", i, e.Frame, err)
+			}
+			continue
+		}
+		if p.Timeout > 0 {
+			c.SetReadDeadline(time.Now().Add(p.Timeout))
+		}
+		got, err := framer.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("entry %d: want %v, got error: %v", i, e.Frame, err)
+		}
+		if !equal(e.Frame, got) {
+			return fmt.Errorf("entry %d: want %v, got %v", i, e.Frame, got)
+		}
+	}
+	if p.Timeout > 0 {
+		c.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+func jsonEqual(want, got Frame) bool {
+	a, err := json.Marshal(want)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(got)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
@@ -0,0 +1,171 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers of HTTP/1.1. They describe a single
+// connection, so a proxy must not forward them; SPDY forbids most of them
+// outright (see invalidReqHeaders and invalidRespHeaders).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ReverseProxy is an http.Handler for a Server that forwards each SPDY
+// stream to an HTTP/1.1 backend and streams the response back. Resetting a
+// stream cancels its backend request.
+type ReverseProxy struct {
+	// Director rewrites the outbound request, typically its URL, before it
+	// is sent. It must not retain the request.
+	Director func(*http.Request)
+
+	// Transport performs the outbound requests. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// NewSingleHostReverseProxy returns a ReverseProxy that sends every request
+// to target, joining target's path with the request's.
+func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
+	director := func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if target.RawQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+		}
+	}
+	return &ReverseProxy{Director: director}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any
+// named in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	// The request's context ends when the stream is reset, which cancels
+	// the backend request.
+	outreq := req.Clone(req.Context())
+	if req.ContentLength == 0 {
+		outreq.Body = nil
+	}
+	outreq.Proto = "HTTP/1.1"
+	outreq.ProtoMajor = 1
+	outreq.ProtoMinor = 1
+	outreq.RequestURI = ""
+	outreq.Close = false
+	removeHopHeaders(outreq.Header)
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := outreq.Header["X-Forwarded-For"]; len(prior) > 0 {
+			host = strings.Join(prior, ", ") + ", " + host
+		}
+		outreq.Header.Set("X-Forwarded-For", host)
+	}
+	if p.Director != nil {
+		p.Director(outreq)
+	}
+
+	res, err := transport.RoundTrip(outreq)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	removeHopHeaders(res.Header)
+	for name, values := range res.Header {
+		rw.Header()[name] = values
+	}
+	// Declare the backend's trailers up front, as it did.
+	announced := len(res.Trailer)
+	if announced > 0 {
+		names := make([]string, 0, announced)
+		for name := range res.Trailer {
+			names = append(names, name)
+		}
+		rw.Header().Add("Trailer", strings.Join(names, ", "))
+	}
+	rw.WriteHeader(res.StatusCode)
+	if err := copyResponse(rw, res.Body); err != nil {
+		// Reset the stream rather than let a truncated body look complete.
+		panic(http.ErrAbortHandler)
+	}
+	// The trailers are known once the body has been read. Those the
+	// backend did not declare go out under http.TrailerPrefix.
+	for name, values := range res.Trailer {
+		if len(res.Trailer) != announced {
+			name = http.TrailerPrefix + name
+		}
+		rw.Header()[name] = values
+	}
+}
+
+// copyResponse copies body to rw, flushing after every read so that
+// streaming responses are not held back.
+func copyResponse(rw http.ResponseWriter, body io.Reader) error {
+	flusher, _ := rw.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := rw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
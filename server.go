@@ -0,0 +1,412 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server serves HTTP requests that arrive as SPDY streams.
+//
+// A client that sends Expect: 100-continue holds the request body back
+// until the server accepts it. As with net/http, the handler accepts by
+// reading the body, or by calling WriteHeader(http.StatusContinue), either of
+// which sends an interim 100 Continue in a HEADERS frame; it rejects by
+// replying without doing either, and the client then sends no body.
+type Server struct {
+	Handler  http.Handler // handler to invoke, http.DefaultServeMux if nil
+	ErrorLog *log.Logger  // logger for handler panics, the log package's if nil
+	Metrics  Metrics      // receives the sessions' metrics, DefaultMetrics if nil
+}
+
+// Serve accepts connections on l and serves each of them as a SPDY session.
+func (srv *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(c)
+	}
+}
+
+// ServeConn serves a single SPDY session on c, returning once the session
+// has ended.
+func (srv *Server) ServeConn(c net.Conn) error {
+	m := srv.Metrics
+	if m == nil {
+		m = DefaultMetrics
+	}
+	s, err := newSession(c, true, m)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			if err == ErrSessionClosed {
+				return nil
+			}
+			return err
+		}
+		go srv.serveStream(c, st)
+	}
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (srv *Server) serveStream(c net.Conn, st *Stream) {
+	req, err := newServerRequest(c, st)
+	if err != nil {
+		st.CloseWithError(ProtocolError)
+		return
+	}
+	// The request's context lives as long as the stream: it is cancelled
+	// when either end resets the stream, when the session ends, and when
+	// the handler returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-st.failed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req = req.WithContext(ctx)
+
+	w := &responseWriter{stream: st, header: make(http.Header)}
+	if b, ok := req.Body.(*requestBody); ok {
+		b.trailer = &req.Trailer // WithContext copied the request
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			w.expect = &expectContinue{stream: st, pending: true}
+			b.expect = w.expect
+		}
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				srv.logf("spdy: panic serving stream %d: %v", st.id, v)
+			}
+			st.CloseWithError(InternalError)
+			return
+		}
+		w.finish()
+	}()
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// newServerRequest builds the request carried by the SYN_STREAM that opened
+// st.
+func newServerRequest(c net.Conn, st *Stream) (*http.Request, error) {
+	h := st.Header()
+	method, path, version, host := h.Get(":method"), h.Get(":path"), h.Get(":version"), h.Get(":host")
+	if method == "" || path == "" || version == "" || host == "" || h.Get(":scheme") == "" {
+		return nil, &Error{Err: InvalidHeaderPresent, StreamId: st.id, FrameType: TypeSynStream, Scope: ScopeStream}
+	}
+	major, minor, ok := http.ParseHTTPVersion(version)
+	if !ok {
+		return nil, &Error{Err: InvalidHeaderPresent, StreamId: st.id, FrameType: TypeSynStream, Scope: ScopeStream}
+	}
+	var u *url.URL
+	if method == "CONNECT" {
+		u = &url.URL{Host: path}
+	} else {
+		var err error
+		if u, err = url.ParseRequestURI(path); err != nil {
+			return nil, err
+		}
+	}
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      version,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     make(http.Header),
+		Trailer:    declaredTrailer(h),
+		Host:       host,
+		RequestURI: path,
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	for name, values := range h {
+		if !strings.HasPrefix(name, ":") {
+			req.Header[name] = values
+		}
+	}
+	if tc, ok := c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.TLS = &state
+	}
+
+	st.mu.Lock()
+	empty := st.recvFin && st.buf.Len() == 0
+	st.mu.Unlock()
+	if empty {
+		req.Body = http.NoBody
+		return req, nil
+	}
+	req.Body = &requestBody{stream: st, trailer: &req.Trailer}
+	req.ContentLength = -1
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			req.ContentLength = n
+		}
+	}
+	return req, nil
+}
+
+// requestBody is the body of a server request. Closing it must not close
+// the stream, whose local side still carries the response.
+type requestBody struct {
+	stream  *Stream
+	trailer *http.Header    // the request's Trailer, filled in at EOF
+	expect  *expectContinue // nil unless the client awaits 100 Continue
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.expect != nil {
+		if err := b.expect.accept(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.stream.Read(p)
+	if err == io.EOF {
+		copyTrailer(b.trailer, b.stream)
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	return nil
+}
+
+// expectContinue tracks a request sent with Expect: 100-continue, whose
+// client holds the body back until the server sends either 100 Continue or
+// its reply.
+type expectContinue struct {
+	mu       sync.Mutex
+	stream   *Stream
+	pending  bool // neither has gone out yet
+	rejected bool // the reply went out first
+}
+
+// accept sends 100 Continue if the client is still waiting for an answer.
+func (c *expectContinue) accept() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pending {
+		return nil
+	}
+	c.pending = false
+	return c.stream.WriteHeaders(http.Header{
+		":status":  {"100 Continue"},
+		":version": {"HTTP/1.1"},
+	}, false)
+}
+
+// reply sends the reply with write, which rejects the body if the client
+// is still waiting for an answer.
+func (c *expectContinue) reply(write func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending {
+		c.pending = false
+		c.rejected = true
+	}
+	return write()
+}
+
+// responseWriter implements http.ResponseWriter on a stream. The SYN_REPLY
+// is held back until the first Write or the end of the handler, so that a
+// response without a body goes out as a single frame.
+type responseWriter struct {
+	stream      *Stream
+	header      http.Header
+	status      int
+	wroteHeader bool     // WriteHeader was called
+	sentReply   bool     // the SYN_REPLY went out
+	trailers    []string // names declared in the Trailer header
+	expect      *expectContinue
+	hijacked    bool
+	err         error
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code == http.StatusContinue {
+		if w.expect != nil && w.err == nil {
+			w.err = w.expect.accept()
+		}
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.sentReply {
+		if w.header.Get("Content-Type") == "" && w.header.Get("Content-Encoding") == "" && len(p) > 0 {
+			w.header.Set("Content-Type", http.DetectContentType(p))
+		}
+		w.sendReply(false)
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.stream.Write(p)
+}
+
+// Flush sends the SYN_REPLY if it has not gone out yet. Data written to the
+// stream is not buffered.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.sentReply {
+		w.sendReply(false)
+	}
+}
+
+// Hijack sends the SYN_REPLY, if it has not gone out yet, and hands the
+// stream over to the caller. Tunnels use this to carry raw bytes on the
+// stream once the request has been accepted.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	w.Flush()
+	if w.err != nil {
+		return nil, nil, w.err
+	}
+	w.hijacked = true
+	rw := bufio.NewReadWriter(bufio.NewReader(w.stream), bufio.NewWriter(w.stream))
+	return w.stream, rw, nil
+}
+
+// sendReply writes the SYN_REPLY, dropping headers that SPDY forbids and
+// those the handler means as trailers.
+func (w *responseWriter) sendReply(fin bool) {
+	w.sentReply = true
+	for name := range declaredTrailer(w.header) {
+		w.trailers = append(w.trailers, name)
+	}
+	h := make(http.Header, len(w.header)+2)
+	for name, values := range w.header {
+		key := http.CanonicalHeaderKey(name)
+		if invalidRespHeaders[key] || strings.HasPrefix(name, http.TrailerPrefix) || w.isTrailer(key) {
+			continue
+		}
+		h[name] = values
+	}
+	h.Set(":status", fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)))
+	h.Set(":version", "HTTP/1.1")
+	if w.expect != nil {
+		w.err = w.expect.reply(func() error { return w.stream.WriteReply(h, fin) })
+		return
+	}
+	w.err = w.stream.WriteReply(h, fin)
+}
+
+func (w *responseWriter) isTrailer(name string) bool {
+	for _, t := range w.trailers {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// trailer returns the trailers the handler has set: the values of the names
+// it declared in the Trailer header, and of those carrying
+// http.TrailerPrefix. It returns nil if there are none.
+func (w *responseWriter) trailer() http.Header {
+	var trailer http.Header
+	add := func(name string, values []string) {
+		if len(values) == 0 || invalidRespHeaders[name] {
+			return
+		}
+		if trailer == nil {
+			trailer = make(http.Header)
+		}
+		trailer[name] = append(trailer[name], values...)
+	}
+	for _, name := range w.trailers {
+		add(name, w.header[name])
+	}
+	for name, values := range w.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			add(http.CanonicalHeaderKey(name[len(http.TrailerPrefix):]), values)
+		}
+	}
+	return trailer
+}
+
+// finish completes the response once the handler has returned. Trailers,
+// if any, go out in a HEADERS frame that closes the stream.
+func (w *responseWriter) finish() {
+	if w.hijacked {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	trailer := w.trailer()
+	if !w.sentReply {
+		w.sendReply(trailer == nil)
+	} else if w.err == nil && trailer == nil {
+		w.stream.Close()
+	}
+	if w.err == nil && trailer != nil {
+		w.stream.WriteHeaders(trailer, true)
+	}
+	// Nobody is left to read the rest of the request body. A client whose
+	// body was rejected before it was sent closes its side by itself.
+	if w.expect != nil && w.expect.rejected {
+		return
+	}
+	st := w.stream
+	st.mu.Lock()
+	unread := !st.recvFin && st.err == nil
+	st.mu.Unlock()
+	if unread {
+		st.CloseWithError(Cancel)
+	}
+}
@@ -0,0 +1,1429 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSession serves h on one end of an in-memory connection and returns
+// a client session on the other end.
+func newTestSession(t *testing.T, h http.Handler) *Session {
+	c, s := net.Pipe()
+	srv := &Server{Handler: h}
+	go srv.ServeConn(s)
+	client, err := NewSession(c, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	return client
+}
+
+func requestHeader(method, path string) http.Header {
+	return http.Header{
+		":method":  {method},
+		":path":    {path},
+		":version": {"HTTP/1.1"},
+		":host":    {"example.com"},
+		":scheme":  {"https"},
+	}
+}
+
+// roundTrip sends a request on a new stream and reads the whole reply.
+func roundTrip(t *testing.T, s *Session, h http.Header, body []byte) (http.Header, []byte) {
+	st, err := s.OpenStream(h, body == nil)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	if body != nil {
+		go func() {
+			st.Write(body)
+			st.Close()
+		}()
+	}
+	reply, err := st.Reply()
+	if err != nil {
+		t.Fatal("Reply:", err)
+	}
+	b, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatal("reading response body:", err)
+	}
+	return reply, b
+}
+
+func TestServerLargeBody(t *testing.T) {
+	// Larger than the initial window in both directions.
+	body := bytes.Repeat([]byte("0123456789abcdef"), 3*defaultInitialWindowSize/16)
+	s := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/upload" || r.Host != "example.com" {
+			t.Errorf("got request %s %s for %s", r.Method, r.URL, r.Host)
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer s.Close()
+	reply, got := roundTrip(t, s, requestHeader("PUT", "/upload"), body)
+	if status := reply.Get(":status"); status != "200 OK" {
+		t.Errorf(":status = %q; want %q", status, "200 OK")
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("echoed %d bytes; want %d", len(got), len(body))
+	}
+}
+
+func TestServerRejectsUnreadUpload(t *testing.T) {
+	s := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer s.Close()
+	st, err := s.OpenStream(requestHeader("PUT", "/upload"), false)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	if _, err := st.Write([]byte("the start of an upload")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	reply, err := st.Reply()
+	if err != nil {
+		t.Fatal("Reply:", err)
+	}
+	// The server resets the stream once it has answered, as nobody reads
+	// the rest of the upload; the answer must survive that.
+	select {
+	case <-st.failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not reset the stream")
+	}
+	if status := reply.Get(":status"); status != "403 Forbidden" {
+		t.Errorf(":status = %q; want %q", status, "403 Forbidden")
+	}
+	b, err := ioutil.ReadAll(st)
+	if err != nil || string(b) != "denied\n" {
+		t.Errorf("read %q, %v; want %q", b, err, "denied\n")
+	}
+	if _, err := st.Write([]byte("more")); err == nil {
+		t.Error("Write after the reset succeeded")
+	}
+}
+
+// countConn is a net.Conn that counts the bytes written to it.
+type countConn struct {
+	net.Conn
+	mu sync.Mutex
+	n  int
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.mu.Lock()
+	c.n += n
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *countConn) written() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestSessionWriteFlushes(t *testing.T) {
+	c, pc := net.Pipe()
+	go io.Copy(ioutil.Discard, pc)
+	cc := &countConn{Conn: c}
+	s, err := newSession(cc, false, nil)
+	if err != nil {
+		t.Fatal("newSession:", err)
+	}
+	defer s.Close()
+	// Queue a frame behind the one waited for, so that the write loop
+	// does not flush as soon as it has written the first.
+	done := make(chan error, 1)
+	s.wmu.Lock()
+	s.wqueue = append(s.wqueue, writeRequest{&PingFrame{Id: 1}, done}, writeRequest{&PingFrame{Id: 3}, nil})
+	s.wcond.Signal()
+	s.wmu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal("write:", err)
+	}
+	if n, want := cc.written(), 12; n < want { // a PING frame is 12 bytes
+		t.Errorf("write reported done with %d bytes on the connection; want at least %d", n, want)
+	}
+}
+
+func TestServerStripsHopHeaders(t *testing.T) {
+	s := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+	reply, _ := roundTrip(t, s, requestHeader("GET", "/"), nil)
+	if status := reply.Get(":status"); status != "204 No Content" {
+		t.Errorf(":status = %q; want %q", status, "204 No Content")
+	}
+	for _, name := range []string{"Connection", "Transfer-Encoding"} {
+		if v := reply.Get(name); v != "" {
+			t.Errorf("reply carried %s: %q", name, v)
+		}
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Proto != "HTTP/1.1" {
+			t.Errorf("backend got %s request", r.Proto)
+		}
+		if r.Header.Get("Te") != "" || r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("hop-by-hop headers were forwarded: %v", r.Header)
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); xff == "" {
+			t.Error("X-Forwarded-For was not set")
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("Trailer", "X-Sum")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bytes.ToUpper(b))
+		w.Header().Set("X-Sum", "5")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	}))
+	defer backend.Close()
+	target, err := url.Parse(backend.URL + "/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// net.Pipe has no host:port address, so serve over loopback.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: NewSingleHostReverseProxy(target)}
+	go srv.Serve(l)
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSession(c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	h := requestHeader("POST", "/echo")
+	h.Set("Te", "trailers")
+	h.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	st, err := s.OpenStream(h, false)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	st.Write([]byte("hello"))
+	st.Close()
+	reply, err := st.Reply()
+	if err != nil {
+		t.Fatal("Reply:", err)
+	}
+	body, err := ioutil.ReadAll(st)
+	if err != nil {
+		t.Fatal("ReadAll:", err)
+	}
+	if status := reply.Get(":status"); status != "201 Created" {
+		t.Errorf(":status = %q; want %q", status, "201 Created")
+	}
+	if got := reply.Get("X-Path"); got != "/base/echo" {
+		t.Errorf("backend saw path %q; want %q", got, "/base/echo")
+	}
+	for _, name := range []string{"X-Backend-Hop", "Keep-Alive", "Connection"} {
+		if v := reply.Get(name); v != "" {
+			t.Errorf("reply carried hop-by-hop header %s: %q", name, v)
+		}
+	}
+	if string(body) != "HELLO" {
+		t.Errorf("body = %q; want %q", body, "HELLO")
+	}
+	want := http.Header{"X-Sum": {"5"}, "X-Late": {"late"}}
+	if got := st.Trailer(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Trailer() = %v; want %v", got, want)
+	}
+}
+
+func TestReverseProxyCancel(t *testing.T) {
+	started := make(chan bool)
+	canceled := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	s := newTestSession(t, NewSingleHostReverseProxy(target))
+	defer s.Close()
+
+	st, err := s.OpenStream(requestHeader("GET", "/slow"), true)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	<-started
+	st.CloseWithError(Cancel)
+	if !<-canceled {
+		t.Fatal("backend request was not canceled by RST_STREAM")
+	}
+}
+
+func TestServerRejectsDataOnUnknownStream(t *testing.T) {
+	c, srvConn := net.Pipe()
+	go (&Server{Handler: http.NotFoundHandler()}).ServeConn(srvConn)
+	defer c.Close()
+	framer, err := NewFramer(c, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go framer.WriteFrame(&DataFrame{StreamId: 5, Data: []byte("x")})
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame:", err)
+	}
+	rst, ok := frame.(*RstStreamFrame)
+	if !ok || rst.StreamId != 5 || rst.Status != InvalidStream {
+		t.Fatalf("got %#v; want RST_STREAM INVALID_STREAM for stream 5", frame)
+	}
+}
+
+// newTunnelTarget listens on loopback and hands each connection to serve.
+func newTunnelTarget(t *testing.T, serve func(c *net.TCPConn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c.(*net.TCPConn))
+		}
+	}()
+	return l
+}
+
+func TestConnectTunnel(t *testing.T) {
+	target := newTunnelTarget(t, func(c *net.TCPConn) {
+		defer c.Close()
+		io.Copy(c, c)
+		c.CloseWrite()
+	})
+	defer target.Close()
+	s := newTestSession(t, &ConnectProxy{})
+	defer s.Close()
+
+	conn, err := DialTunnel(s, target.Addr().String())
+	if err != nil {
+		t.Fatal("DialTunnel:", err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal("Write:", err)
+	}
+	// Half-close: the target only echoes back once it sees EOF.
+	if err := conn.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal("ReadAll:", err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("tunnel echoed %q; want %q", b, "ping")
+	}
+}
+
+func TestConnectTunnelReadDeadline(t *testing.T) {
+	target := newTunnelTarget(t, func(c *net.TCPConn) {
+		io.Copy(ioutil.Discard, c)
+	})
+	defer target.Close()
+	s := newTestSession(t, &ConnectProxy{})
+	defer s.Close()
+
+	var conn net.Conn
+	conn, err := DialTunnel(s, target.Addr().String())
+	if err != nil {
+		t.Fatal("DialTunnel:", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read past the deadline returned %v; want a timeout", err)
+	}
+}
+
+func TestConnectTunnelDialError(t *testing.T) {
+	dial := func(network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: io.ErrUnexpectedEOF}
+	}
+	s := newTestSession(t, &ConnectProxy{Dial: dial})
+	defer s.Close()
+	_, err := DialTunnel(s, "127.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("DialTunnel returned %v; want a 502 error", err)
+	}
+}
+
+func TestConnectTunnelNotAllowed(t *testing.T) {
+	dialed := false
+	p := &ConnectProxy{
+		Allow: func(addr string) bool { return addr == "example.com:443" },
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = true
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	s := newTestSession(t, p)
+	defer s.Close()
+	_, err := DialTunnel(s, "10.0.0.1:22")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("DialTunnel returned %v; want a 403 error", err)
+	}
+	if dialed {
+		t.Error("ConnectProxy dialed a target Allow refused")
+	}
+}
+
+func TestConnectProxyNotHijacker(t *testing.T) {
+	p := &ConnectProxy{
+		Dial: func(network, addr string) (net.Conn, error) {
+			t.Error("ConnectProxy dialed without a stream to tunnel over")
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("CONNECT", "http://example.com:443", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestConnectTunnelTargetReset(t *testing.T) {
+	target := newTunnelTarget(t, func(c *net.TCPConn) {
+		c.Read(make([]byte, 1))
+		c.SetLinger(0)
+		c.Close()
+	})
+	defer target.Close()
+	s := newTestSession(t, &ConnectProxy{})
+	defer s.Close()
+
+	conn, err := DialTunnel(s, target.Addr().String())
+	if err != nil {
+		t.Fatal("DialTunnel:", err)
+	}
+	conn.Write([]byte("x"))
+	_, err = ioutil.ReadAll(conn)
+	if e, ok := err.(*StreamResetError); !ok || !e.Remote || e.Status != InternalError {
+		t.Fatalf("ReadAll returned %v; want the stream reset with INTERNAL_ERROR", err)
+	}
+}
+
+func TestStreamWriteDeadline(t *testing.T) {
+	s := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never read the body, so the window is never replenished.
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+	st, err := s.OpenStream(requestHeader("POST", "/"), false)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	st.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := st.Write(make([]byte, 2*defaultInitialWindowSize))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Write returned %v; want a timeout", err)
+	}
+	if n != defaultInitialWindowSize {
+		t.Errorf("Write wrote %d bytes before timing out; want %d", n, defaultInitialWindowSize)
+	}
+	if _, err := st.Write([]byte("x")); err == nil {
+		t.Error("Write after the deadline succeeded")
+	}
+}
+
+func TestStreamCloseWithError(t *testing.T) {
+	errc := make(chan error, 1)
+	s := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		errc <- err
+	}))
+	defer s.Close()
+	st, err := s.OpenStream(requestHeader("POST", "/"), false)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	if st.LocalAddr() != s.conn.LocalAddr() || st.RemoteAddr() != s.conn.RemoteAddr() {
+		t.Errorf("stream addresses %v, %v differ from the session's", st.LocalAddr(), st.RemoteAddr())
+	}
+	st.Write([]byte("partial"))
+	if err := st.CloseWithError(RefusedStream); err != nil {
+		t.Fatal("CloseWithError:", err)
+	}
+	err = <-errc
+	if e, ok := err.(*StreamResetError); !ok || !e.Remote || e.Status != RefusedStream {
+		t.Fatalf("server read %v; want the stream reset with REFUSED_STREAM", err)
+	}
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Error("Read after CloseWithError succeeded")
+	}
+}
+
+func TestRecorderConnLenient(t *testing.T) {
+	var log bytes.Buffer
+	rec := NewRecorder(&log)
+	c, pc := net.Pipe()
+	go io.Copy(ioutil.Discard, pc)
+	rc := rec.Conn(c)
+	defer rc.Close()
+	// A version 2 PING, which lenient mode reads as version 3, then a
+	// control frame of an unknown type, which cannot be decoded.
+	rc.Write([]byte{0x80, 2, 0, byte(TypePing), 0, 0, 0, 4, 0, 0, 0, 1})
+	if err := rec.Err(); err != nil {
+		t.Fatal("recording:", err)
+	}
+	rc.Write([]byte{0x80, Version, 0, 0x63, 0, 0, 0, 0})
+	if err := rec.Err(); !errors.Is(err, ErrInvalidControlFrame) {
+		t.Errorf("Err() = %v; want InvalidControlFrame", err)
+	}
+	warnings := rec.Warnings()
+	if len(warnings) != 1 || warnings[0].Err != UnsupportedFrameVersion {
+		t.Errorf("Warnings() = %v; want one UnsupportedFrameVersion", warnings)
+	}
+	entries, err := ReadRecording(&log)
+	if err != nil {
+		t.Fatal("ReadRecording:", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("recorded %v; want the PING", entries)
+	}
+	if ping, ok := entries[0].Frame.(*PingFrame); !ok || ping.Id != 1 || !entries[0].Sent {
+		t.Errorf("recorded %v; want PING 1 sent", entries[0])
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello "+r.URL.Path)
+	})
+	var log bytes.Buffer
+	rec := NewRecorder(&log)
+	c, sc := net.Pipe()
+	go (&Server{Handler: handler}).ServeConn(sc)
+	rc := rec.Conn(c)
+	s, err := NewSession(rc, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	_, want := roundTrip(t, s, requestHeader("GET", "/a"), nil)
+	rc.Close()
+	if err := rec.Err(); err != nil {
+		t.Fatal("recording:", err)
+	}
+	entries, err := ReadRecording(&log)
+	if err != nil {
+		t.Fatal("ReadRecording:", err)
+	}
+	if len(entries) < 2 || !entries[0].Sent || entries[len(entries)-1].Sent {
+		t.Fatalf("recorded %v; want the request sent first and the response received last", entries)
+	}
+
+	replay := func(path string) (body []byte, err error) {
+		c, pc := net.Pipe()
+		defer c.Close()
+		defer pc.Close()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- (&Replayer{Entries: entries, Timeout: time.Second}).Replay(pc)
+		}()
+		s, err := NewSession(c, false)
+		if err != nil {
+			t.Fatal("NewSession:", err)
+		}
+		st, err := s.OpenStream(requestHeader("GET", path), true)
+		if err != nil {
+			t.Fatal("OpenStream:", err)
+		}
+		if err := <-errc; err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(st)
+	}
+	got, err := replay("/a")
+	if err != nil {
+		t.Fatal("Replay:", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("replayed body %q; want %q", got, want)
+	}
+	if _, err := replay("/b"); err == nil || !strings.Contains(err.Error(), "entry 0") {
+		t.Errorf("Replay with a different request returned %v; want a mismatch at entry 0", err)
+	}
+}
+
+// countMetrics is a Metrics that counts what it is told, by method and
+// argument. If closed is not nil, SessionClosed sends on it.
+type countMetrics struct {
+	mu     sync.Mutex
+	n      map[string]int64
+	closed chan struct{}
+}
+
+func (m *countMetrics) add(key string, n int64) {
+	m.mu.Lock()
+	if m.n == nil {
+		m.n = make(map[string]int64)
+	}
+	m.n[key] += n
+	m.mu.Unlock()
+}
+
+func (m *countMetrics) get(key string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.n[key]
+}
+
+func (m *countMetrics) SessionOpened() { m.add("sessions", 1) }
+
+func (m *countMetrics) SessionClosed() {
+	m.add("sessions", -1)
+	if m.closed != nil {
+		m.closed <- struct{}{}
+	}
+}
+
+func (m *countMetrics) StreamOpened() { m.add("streams", 1) }
+func (m *countMetrics) StreamClosed() { m.add("streams", -1) }
+
+func (m *countMetrics) FrameRead(frameType string, wireBytes int) {
+	m.add("read "+frameType, 1)
+	m.add("bytes read", int64(wireBytes))
+}
+
+func (m *countMetrics) FrameWritten(frameType string, wireBytes int) {
+	m.add("written "+frameType, 1)
+}
+
+func (m *countMetrics) HeadersCompressed(uncompressed, compressed int) {
+	m.add("header bytes", int64(compressed))
+}
+
+func (m *countMetrics) StreamReset(status RstStreamStatus, remote bool) {
+	m.add(fmt.Sprintf("reset %v remote=%v", status, remote), 1)
+}
+
+func (m *countMetrics) GoAway(status GoAwayStatus, remote bool) {
+	m.add(fmt.Sprintf("goaway %v remote=%v", status, remote), 1)
+}
+
+func (m *countMetrics) PingRTT(rtt time.Duration)        { m.add("pings", 1) }
+func (m *countMetrics) FlowControlStall(d time.Duration) { m.add("stalls", 1) }
+
+func TestSessionMetrics(t *testing.T) {
+	srvMetrics := &countMetrics{closed: make(chan struct{}, 1)}
+	cliMetrics := new(countMetrics)
+	c, sc := net.Pipe()
+	srv := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}),
+		Metrics: srvMetrics,
+	}
+	go srv.ServeConn(sc)
+	s, err := newSession(c, false, cliMetrics)
+	if err != nil {
+		t.Fatal("newSession:", err)
+	}
+	roundTrip(t, s, requestHeader("GET", "/"), nil)
+	if _, err := s.Ping(); err != nil {
+		t.Fatal("Ping:", err)
+	}
+	st, err := s.OpenStream(requestHeader("POST", "/"), false)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	st.CloseWithError(Cancel)
+	s.Close()
+
+	if n := cliMetrics.get("written SYN_STREAM"); n != 2 {
+		t.Errorf("client wrote %d SYN_STREAM frames; want 2", n)
+	}
+	if n := cliMetrics.get("read DATA"); n < 1 {
+		t.Errorf("client read %d DATA frames; want at least 1", n)
+	}
+	if n := cliMetrics.get("reset CANCEL remote=false"); n != 1 {
+		t.Errorf("client sent %d CANCEL resets; want 1", n)
+	}
+	if n := cliMetrics.get("goaway OK remote=false"); n != 1 {
+		t.Errorf("client sent %d GOAWAY OK frames; want 1", n)
+	}
+	if cliMetrics.get("bytes read") == 0 || cliMetrics.get("header bytes") == 0 {
+		t.Error("client counted no bytes read or no header bytes")
+	}
+	if n := cliMetrics.get("pings"); n != 1 {
+		t.Errorf("client measured %d pings; want 1", n)
+	}
+	if n := cliMetrics.get("streams"); n != 0 {
+		t.Errorf("client has %d active streams after Close; want 0", n)
+	}
+	if n := cliMetrics.get("sessions"); n != 0 {
+		t.Errorf("client has %d active sessions after Close; want 0", n)
+	}
+	// The server's session ends once it has read all of the client's
+	// frames.
+	select {
+	case <-srvMetrics.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session did not end")
+	}
+	if n := srvMetrics.get("read SYN_STREAM"); n != 2 {
+		t.Errorf("server read %d SYN_STREAM frames; want 2", n)
+	}
+	if n := srvMetrics.get("reset CANCEL remote=true"); n != 1 {
+		t.Errorf("server received %d CANCEL resets; want 1", n)
+	}
+}
+
+func TestNoExpvar(t *testing.T) {
+	// The package must not depend on expvar, whose import publishes
+	// /debug/vars on http.DefaultServeMux.
+	pkg, err := build.ImportDir(".", 0)
+	if err != nil {
+		t.Fatal("ImportDir:", err)
+	}
+	type dep struct{ path, srcDir string }
+	var queue []dep
+	for _, path := range pkg.Imports {
+		queue = append(queue, dep{path, pkg.Dir})
+	}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if d.path == "C" || seen[d.path] {
+			continue
+		}
+		seen[d.path] = true
+		if d.path == "expvar" {
+			t.Fatal("the package depends on expvar")
+		}
+		p, err := build.Import(d.path, d.srcDir, 0)
+		if err != nil {
+			t.Fatalf("Import %s: %v", d.path, err)
+		}
+		for _, path := range p.Imports {
+			queue = append(queue, dep{path, p.Dir})
+		}
+	}
+}
+
+// newTestTransport returns a Transport whose every session is served by h
+// over an in-memory connection.
+func newTestTransport(h http.Handler) *Transport {
+	return &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go (&Server{Handler: h}).ServeConn(s)
+			return c, nil
+		},
+	}
+}
+
+func TestTransport(t *testing.T) {
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Accept", r.Header.Get("Accept"))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(bytes.ToUpper(b))
+	}))
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+	for _, body := range []string{"", "hello"} {
+		req, _ := http.NewRequest("POST", "https://example.com/x?y=1", strings.NewReader(body))
+		req.Header.Set("Accept", "text/plain")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal("Do:", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal("reading body:", err)
+		}
+		if resp.StatusCode != http.StatusAccepted || resp.Header.Get("X-Method") != "POST" || resp.Header.Get("X-Accept") != "text/plain" {
+			t.Errorf("got %s with header %v", resp.Status, resp.Header)
+		}
+		if string(b) != strings.ToUpper(body) {
+			t.Errorf("body = %q; want %q", b, strings.ToUpper(body))
+		}
+	}
+	if n := len(tr.sessions); n != 1 {
+		t.Errorf("transport has %d sessions; want 1", n)
+	}
+}
+
+func TestTransportSlowDial(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	dials := make(map[string]int)
+	tr := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dials[addr]++
+			mu.Unlock()
+			if strings.HasPrefix(addr, "slow.") {
+				<-release
+			}
+			c, s := net.Pipe()
+			go (&Server{Handler: handler}).ServeConn(s)
+			return c, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	get := func(url string) error {
+		req, _ := http.NewRequest("GET", url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	slow := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { slow <- get("https://slow.example/") }()
+	}
+
+	// Another host is served while the slow one is still dialing.
+	if err := get("https://fast.example/"); err != nil {
+		t.Fatal("fast host:", err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-slow; err != nil {
+			t.Fatal("slow host:", err)
+		}
+	}
+	if n := dials["slow.example:443"]; n != 1 {
+		t.Errorf("slow host dialed %d times; want 1", n)
+	}
+}
+
+func TestTransportDialWaitCancel(t *testing.T) {
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	tr := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			close(dialing)
+			<-release
+			c, s := net.Pipe()
+			go (&Server{Handler: http.NotFoundHandler()}).ServeConn(s)
+			return c, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	first := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "https://slow.example/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		first <- err
+	}()
+	<-dialing
+
+	// A request waiting on the first one's dial gives up when cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://slow.example/", nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTrip(req)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond) // let it start waiting
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("cancelled request: got %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled request still waiting on the dial")
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal("first request:", err)
+	}
+}
+
+func TestTransportCloseIdleConnections(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "busy.example" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "ok")
+	})
+	tr := &Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			c, s := net.Pipe()
+			go (&Server{Handler: handler}).ServeConn(s)
+			return c, nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+	get := func(url string) error {
+		req, _ := http.NewRequest("GET", url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	if err := get("https://idle.example/"); err != nil {
+		t.Fatal("idle host:", err)
+	}
+	busy := make(chan error, 1)
+	go func() { busy <- get("https://busy.example/") }()
+	<-started
+
+	tr.mu.Lock()
+	idle, inFlight := tr.sessions["https://idle.example:443"], tr.sessions["https://busy.example:443"]
+	tr.mu.Unlock()
+	tr.CloseIdleConnections()
+	select {
+	case <-idle.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session still open")
+	}
+	if inFlight.closed() {
+		t.Error("session with a request in flight was closed")
+	}
+	close(release)
+	if err := <-busy; err != nil {
+		t.Fatal("busy host:", err)
+	}
+}
+
+func TestServerTrailers(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Checksum", "early")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Undeclared", "def")
+		w.Header().Set(http.TrailerPrefix+"Connection", "close")
+	})
+	var log bytes.Buffer
+	rec := NewRecorder(&log)
+	c, sc := net.Pipe()
+	go (&Server{Handler: handler}).ServeConn(sc)
+	rc := rec.Conn(c)
+	s, err := NewSession(rc, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	st, err := s.OpenStream(requestHeader("GET", "/"), true)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	reply, err := st.Reply()
+	if err != nil {
+		t.Fatal("Reply:", err)
+	}
+	if reply.Get("Trailer") != "X-Checksum" || reply.Get("X-Checksum") != "" {
+		t.Errorf("reply header %v; want the trailer declared but not sent", reply)
+	}
+	if b, err := ioutil.ReadAll(st); err != nil || string(b) != "body" {
+		t.Fatalf("read %q, %v; want %q", b, err, "body")
+	}
+	want := http.Header{"X-Checksum": {"abc"}, "X-Undeclared": {"def"}}
+	if got := st.Trailer(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Trailer() = %v; want %v", got, want)
+	}
+	rc.Close()
+
+	entries, err := ReadRecording(&log)
+	if err != nil {
+		t.Fatal("ReadRecording:", err)
+	}
+	last := entries[len(entries)-1].Frame
+	if frame, ok := last.(*HeadersFrame); !ok || frame.CFHeader.Flags&ControlFlagFin == 0 {
+		t.Errorf("last frame received is %v; want HEADERS with FLAG_FIN", last)
+	}
+}
+
+func TestTransportTrailers(t *testing.T) {
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Trailer["X-Request-Sum"]; !ok {
+			t.Errorf("request Trailer %v lacks the declared X-Request-Sum", r.Trailer)
+		}
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Response-Sum")
+		io.WriteString(w, "response")
+		w.Header().Set("X-Response-Sum", "r:"+r.Trailer.Get("X-Request-Sum"))
+	}))
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("POST", "https://example.com/", strings.NewReader("request"))
+	req.Trailer = http.Header{"X-Request-Sum": nil}
+	req.Body = ioutil.NopCloser(io.MultiReader(req.Body, readerFunc(func([]byte) (int, error) {
+		req.Trailer.Set("X-Request-Sum", "42")
+		return 0, io.EOF
+	})))
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal("Do:", err)
+	}
+	defer resp.Body.Close()
+	if want := (http.Header{"X-Response-Sum": nil}); !reflect.DeepEqual(resp.Trailer, want) {
+		t.Errorf("Trailer before the body = %v; want %v", resp.Trailer, want)
+	}
+	if b, err := ioutil.ReadAll(resp.Body); err != nil || string(b) != "response" {
+		t.Fatalf("read %q, %v; want %q", b, err, "response")
+	}
+	if got := resp.Trailer.Get("X-Response-Sum"); got != "r:42" {
+		t.Errorf("X-Response-Sum trailer = %q; want %q", got, "r:42")
+	}
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// signalReader closes started on its first Read and closed on Close.
+type signalReader struct {
+	io.Reader
+	started, closed chan struct{}
+	once            sync.Once
+}
+
+func newSignalReader(s string) *signalReader {
+	return &signalReader{Reader: strings.NewReader(s), started: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (r *signalReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	return r.Reader.Read(p)
+}
+
+func (r *signalReader) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func TestTransportExpectContinue(t *testing.T) {
+	var body *signalReader
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-body.started:
+			t.Error("body was sent before the handler read it")
+		case <-time.After(20 * time.Millisecond):
+		}
+		if r.URL.Path == "/reject" {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			io.WriteString(w, "too large")
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	tr.ExpectContinueTimeout = time.Hour
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	for _, tt := range []struct {
+		path, want string
+		status     int
+	}{
+		{"/accept", "upload", http.StatusOK},
+		{"/reject", "too large", http.StatusRequestEntityTooLarge},
+	} {
+		body = newSignalReader("upload")
+		req, _ := http.NewRequest("PUT", "https://example.com"+tt.path, body)
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: Do: %v", tt.path, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != tt.status || string(b) != tt.want {
+			t.Errorf("%s: got %s %q, %v; want %d %q", tt.path, resp.Status, b, err, tt.status, tt.want)
+		}
+		select {
+		case <-body.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: request body was not closed", tt.path)
+		}
+		if tt.status != http.StatusOK {
+			select {
+			case <-body.started:
+				t.Errorf("%s: rejected body was read", tt.path)
+			default:
+			}
+		}
+	}
+}
+
+func TestTransportExpectContinueTimeout(t *testing.T) {
+	var body *signalReader
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hold off reading until the client gives up waiting.
+		select {
+		case <-body.started:
+		case <-time.After(5 * time.Second):
+			t.Error("body was not sent once the timeout passed")
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	tr.ExpectContinueTimeout = 10 * time.Millisecond
+	defer tr.CloseIdleConnections()
+	body = newSignalReader("upload")
+	req, _ := http.NewRequest("PUT", "https://example.com/", body)
+	req.Header.Set("Expect", "100-continue")
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal("Do:", err)
+	}
+	defer resp.Body.Close()
+	if b, err := ioutil.ReadAll(resp.Body); err != nil || string(b) != "upload" {
+		t.Errorf("read %q, %v; want %q", b, err, "upload")
+	}
+}
+
+func TestServeCleartext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "spdy "+r.URL.Path)
+	})}
+	go srv.ServeCleartext(l)
+	defer l.Close()
+	url := "http://" + l.Addr().String() + "/x"
+
+	for _, mode := range []CleartextMode{PriorKnowledge, Upgrade} {
+		tr := &Transport{Cleartext: func(string) CleartextMode { return mode }}
+		resp, err := (&http.Client{Transport: tr}).Get(url)
+		if err != nil {
+			t.Fatalf("%v: Get: %v", mode, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+		if err != nil || string(b) != "spdy /x" {
+			t.Errorf("%v: read %q, %v; want %q", mode, b, err, "spdy /x")
+		}
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal("HTTP/1.1 Get:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != "spdy/3" {
+		t.Errorf("HTTP/1.1 request got %s with Upgrade %q; want 426 offering spdy/3", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	// The body of an upgrade request is skipped, not read as frames.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "POST / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\n"+
+		"Upgrade: spdy/3\r\nContent-Length: 4\r\n\r\nbody")
+	br := bufio.NewReader(c)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal("ReadResponse:", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade with a body got %s; want 101", resp.Status)
+	}
+	s, err := NewSession(&peekedConn{c, br}, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	defer s.Close()
+	if _, body := roundTrip(t, s, requestHeader("GET", "/y"), nil); string(body) != "spdy /y" {
+		t.Errorf("after the upgrade read %q; want %q", body, "spdy /y")
+	}
+}
+
+func TestUpgradeHandler(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "spdy")
+	})}
+	h1 := httptest.NewServer(srv.UpgradeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "http/1.1")
+	})))
+	defer h1.Close()
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	upgradeTo := func(addr string) CleartextMode {
+		if addr == h1.Listener.Addr().String() || addr == plain.Listener.Addr().String() {
+			return Upgrade
+		}
+		return PriorKnowledge
+	}
+	tr := &Transport{Cleartext: upgradeTo}
+	defer tr.CloseIdleConnections()
+	get := func(c *http.Client, url string) string {
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatalf("Get %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+	if got := get(&http.Client{Transport: tr}, h1.URL); got != "spdy" {
+		t.Errorf("over the transport got %q; want %q", got, "spdy")
+	}
+	if got := get(h1.Client(), h1.URL); got != "http/1.1" {
+		t.Errorf("over HTTP/1.1 got %q; want %q", got, "http/1.1")
+	}
+	// A request with a body is served as it is, not upgraded.
+	req, err := http.NewRequest("POST", h1.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "spdy/3")
+	resp, err := h1.Client().Do(req)
+	if err != nil {
+		t.Fatal("POST asking to upgrade:", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "http/1.1" {
+		t.Errorf("POST asking to upgrade got %s %q; want 200 %q", resp.Status, b, "http/1.1")
+	}
+	if _, err := (&http.Client{Transport: tr}).Get(plain.URL); err == nil || !strings.Contains(err.Error(), "refused to upgrade") {
+		t.Errorf("upgrading a server without SPDY returned %v; want a refusal", err)
+	}
+}
+
+func TestUpgradeHandlerTimeouts(t *testing.T) {
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "spdy")
+	})}
+	h1 := httptest.NewUnstartedServer(srv.UpgradeHandler(http.NotFoundHandler()))
+	h1.Config.ReadTimeout = 50 * time.Millisecond
+	h1.Config.WriteTimeout = 50 * time.Millisecond
+	h1.Start()
+	defer h1.Close()
+	tr := &Transport{Cleartext: func(string) CleartextMode { return Upgrade }}
+	defer tr.CloseIdleConnections()
+	c := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			// Outlast the http.Server's timeouts.
+			time.Sleep(100 * time.Millisecond)
+		}
+		resp, err := c.Get(h1.URL)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != "spdy" {
+			t.Fatalf("request %d: read %q, %v; want %q", i, b, err, "spdy")
+		}
+	}
+	if n := len(tr.sessions); n != 1 {
+		t.Errorf("transport has %d sessions; want the one it upgraded", n)
+	}
+}
+
+func TestSniffListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "spdy "+r.URL.Path)
+	})}
+	h1 := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "http/1.1 "+r.URL.Path)
+	})}
+	served := make(chan error, 1)
+	go func() { served <- h1.Serve(NewSniffListener(l, srv)) }()
+	url := "http://" + l.Addr().String() + "/x"
+
+	tr := &Transport{}
+	defer tr.CloseIdleConnections()
+	plain := &http.Transport{}
+	defer plain.CloseIdleConnections()
+	for _, tt := range []struct {
+		rt   http.RoundTripper
+		want string
+	}{
+		{tr, "spdy /x"},
+		{plain, "http/1.1 /x"},
+	} {
+		resp, err := (&http.Client{Transport: tt.rt}).Get(url)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != tt.want {
+			t.Errorf("read %q, %v; want %q", b, err, tt.want)
+		}
+	}
+
+	h1.Close()
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("Serve returned %v; want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
+
+func TestTransportCancel(t *testing.T) {
+	started := make(chan struct{})
+	handlerErr := make(chan error, 1)
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		handlerErr <- r.Context().Err()
+	}))
+	defer tr.CloseIdleConnections()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	req = req.WithContext(ctx)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := tr.RoundTrip(req); err != context.Canceled {
+		t.Errorf("RoundTrip returned %v; want %v", err, context.Canceled)
+	}
+	select {
+	case err := <-handlerErr:
+		if err != context.Canceled {
+			t.Errorf("handler context ended with %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context was not cancelled")
+	}
+}
+
+func TestTransportCancelDuringBody(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		handlerErr <- r.Context().Err()
+	}))
+	defer tr.CloseIdleConnections()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	resp, err := tr.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal("RoundTrip:", err)
+	}
+	defer resp.Body.Close()
+	b := make([]byte, 7)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		t.Fatal("reading body:", err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(resp.Body); err != context.Canceled {
+		t.Errorf("reading body after cancel returned %v; want %v", err, context.Canceled)
+	}
+	if err := <-handlerErr; err != context.Canceled {
+		t.Errorf("handler context ended with %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestServerResetReachesClient(t *testing.T) {
+	tr := newTestTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal("RoundTrip:", err)
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	if e, ok := err.(*StreamResetError); !ok || !e.Remote || e.Status != InternalError {
+		t.Errorf("reading body returned %v; want the stream reset with INTERNAL_ERROR", err)
+	}
+}
+
+func TestServerContextSessionClose(t *testing.T) {
+	started := make(chan struct{})
+	handlerErr := make(chan error, 1)
+	s := newTestSession(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		handlerErr <- r.Context().Err()
+	}))
+	if _, err := s.OpenStream(requestHeader("GET", "/"), true); err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	<-started
+	s.Close()
+	select {
+	case err := <-handlerErr:
+		if err != context.Canceled {
+			t.Errorf("handler context ended with %v; want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the session did not cancel the handler context")
+	}
+}
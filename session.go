@@ -0,0 +1,616 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultInitialWindowSize is the flow control window every stream
+	// starts with until a SETTINGS frame says otherwise.
+	defaultInitialWindowSize = 64 << 10
+
+	// maxDataChunk caps the payload of each DATA frame a Stream writes.
+	maxDataChunk = 16 << 10
+
+	// acceptBacklog is the number of peer-initiated streams that may wait
+	// for Accept before further streams are refused.
+	acceptBacklog = 128
+)
+
+// ErrSessionClosed is returned by operations on a Session, and on its
+// streams, after the session has ended.
+var ErrSessionClosed = errors.New("session closed")
+
+// ErrGoAway is returned by OpenStream after the peer has sent GOAWAY.
+var ErrGoAway = errors.New("session is going away")
+
+// Session is a SPDY connection, multiplexing streams over a net.Conn. A
+// single goroutine reads frames from the connection and another writes
+// them, so frames are never interleaved and a slow writer never stalls the
+// reader.
+type Session struct {
+	conn   net.Conn
+	framer *Framer
+	bw     *bufio.Writer
+	server bool
+
+	wmu      sync.Mutex // guards wqueue, wstopped and werr
+	wcond    *sync.Cond
+	wqueue   []writeRequest
+	wstopped bool  // the write loop has returned
+	werr     error // what writes queued since then fail with
+
+	mu            sync.Mutex // guards the fields below
+	streams       map[StreamId]*Stream
+	nextId        StreamId // id of the next locally initiated stream
+	lastPeerId    StreamId // highest peer-initiated stream id seen
+	initialWindow int32    // initial send window set by the peer
+	goAwaySent    bool
+	goAwayRecv    bool
+	err           error // why the session ended, if it has
+
+	pings      map[uint32]chan struct{} // pings awaiting their echo, by id
+	nextPingId uint32
+
+	metrics Metrics
+	accept  chan *Stream
+	done    chan struct{}
+}
+
+// writeRequest is a frame waiting for the write loop. done, if not nil,
+// receives the result of writing the frame.
+type writeRequest struct {
+	frame Frame
+	done  chan error
+}
+
+// NewSession starts a SPDY session over conn. server selects which end of
+// the connection the session speaks for, which decides the parity of the
+// stream ids it opens.
+func NewSession(conn net.Conn, server bool) (*Session, error) {
+	return newSession(conn, server, DefaultMetrics)
+}
+
+// newSession is NewSession reporting to m, which may be nil.
+func newSession(conn net.Conn, server bool, m Metrics) (*Session, error) {
+	bw := bufio.NewWriter(conn)
+	framer, err := NewFramer(bw, bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = nopMetrics{}
+	}
+	framer.SetHooks(metricsHooks(m))
+	s := &Session{
+		conn:          conn,
+		framer:        framer,
+		bw:            bw,
+		server:        server,
+		streams:       make(map[StreamId]*Stream),
+		nextId:        1,
+		initialWindow: defaultInitialWindowSize,
+		pings:         make(map[uint32]chan struct{}),
+		nextPingId:    1,
+		metrics:       m,
+		accept:        make(chan *Stream, acceptBacklog),
+		done:          make(chan struct{}),
+	}
+	if server {
+		s.nextId = 2
+		s.nextPingId = 2
+	}
+	m.SessionOpened()
+	s.wcond = sync.NewCond(&s.wmu)
+	go s.readLoop()
+	go s.writeLoop()
+	return s, nil
+}
+
+// OpenStream opens a new stream by sending a SYN_STREAM frame carrying h. If
+// fin is set the local side of the stream is closed straight away.
+func (s *Session) OpenStream(h http.Header, fin bool) (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.goAwayRecv || s.goAwaySent {
+		s.mu.Unlock()
+		return nil, ErrGoAway
+	}
+	st := newStream(s, s.nextId, s.initialWindow)
+	st.local = true
+	st.sendFin = fin
+	s.nextId += 2
+	s.streams[st.id] = st
+	s.metrics.StreamOpened()
+	frame := &SynStreamFrame{StreamId: st.id, Headers: h}
+	if fin {
+		frame.CFHeader.Flags = ControlFlagFin
+	}
+	// Queue the frame before unlocking so that stream ids reach the wire in
+	// increasing order.
+	done := s.queueFrame(frame, true)
+	s.mu.Unlock()
+	if err := <-done; err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream and returns it.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+// Close sends GOAWAY and closes the underlying connection. Streams still
+// open fail with ErrSessionClosed.
+func (s *Session) Close() error {
+	s.goAway(GoAwayOK)
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// Ping sends a PING frame and waits for the peer to echo it, returning the
+// round trip time.
+func (s *Session) Ping() (time.Duration, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return 0, s.err
+	}
+	id := s.nextPingId
+	s.nextPingId += 2
+	echo := make(chan struct{})
+	s.pings[id] = echo
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(&PingFrame{Id: id}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-echo:
+	case <-s.done:
+		return 0, s.Err()
+	}
+	rtt := time.Since(start)
+	s.metrics.PingRTT(rtt)
+	return rtt, nil
+}
+
+// pingReply wakes the Ping waiting for the echo of id, if any.
+func (s *Session) pingReply(id uint32) {
+	s.mu.Lock()
+	echo := s.pings[id]
+	delete(s.pings, id)
+	s.mu.Unlock()
+	if echo != nil {
+		close(echo)
+	}
+}
+
+// Err returns the reason the session ended, or nil while it is running.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// closed reports whether the session has ended. Unlike Err it does not
+// take s.mu, so it is safe to call with s.wmu held.
+func (s *Session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// idle reports whether the session has no open streams.
+func (s *Session) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams) == 0
+}
+
+// Done returns a channel that is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[StreamId]*Stream)
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+		s.metrics.StreamClosed()
+	}
+	s.metrics.SessionClosed()
+	s.wmu.Lock()
+	s.wcond.Broadcast()
+	s.wmu.Unlock()
+}
+
+// queueFrame hands frame to the write loop. If wait is set the returned
+// channel receives the result of the write.
+func (s *Session) queueFrame(frame Frame, wait bool) chan error {
+	var done chan error
+	if wait {
+		done = make(chan error, 1)
+	}
+	s.wmu.Lock()
+	if s.wstopped {
+		err := s.werr
+		s.wmu.Unlock()
+		if done != nil {
+			done <- err
+		}
+		return done
+	}
+	s.wqueue = append(s.wqueue, writeRequest{frame, done})
+	s.wcond.Signal()
+	s.wmu.Unlock()
+	return done
+}
+
+// writeFrame writes frame and waits for the result. It does not return
+// before the write loop is done with frame, so the caller may reuse what
+// frame refers to.
+func (s *Session) writeFrame(frame Frame) error {
+	return <-s.queueFrame(frame, true)
+}
+
+func (s *Session) writeLoop() {
+	// Frames are flushed once the queue runs dry. Those whose writers
+	// wait are only reported written once they have been flushed, so that
+	// a GOAWAY written by Close reaches the connection before it closes.
+	var unflushed []chan error
+	for {
+		s.wmu.Lock()
+		for len(s.wqueue) == 0 && !s.closed() {
+			s.wcond.Wait()
+		}
+		if s.closed() {
+			s.wmu.Unlock()
+			s.stopWriting(unflushed)
+			return
+		}
+		req := s.wqueue[0]
+		s.wqueue = s.wqueue[1:]
+		more := len(s.wqueue) > 0
+		s.wmu.Unlock()
+
+		err := s.framer.WriteFrame(req.frame)
+		if req.done != nil {
+			if err != nil {
+				req.done <- err
+			} else {
+				unflushed = append(unflushed, req.done)
+			}
+		}
+		if !more {
+			ferr := s.bw.Flush()
+			for _, done := range unflushed {
+				done <- ferr
+			}
+			unflushed = unflushed[:0]
+			if err == nil {
+				err = ferr
+			}
+		}
+		if err != nil {
+			if _, ok := err.(*Error); !ok {
+				s.closeWithError(err)
+			}
+		}
+	}
+}
+
+// stopWriting fails the writes still waiting once the session has ended,
+// and those queued later, with the reason it ended. Frames left in the
+// queue are dropped, as the connection is closed.
+func (s *Session) stopWriting(unflushed []chan error) {
+	err := s.Err()
+	for _, done := range unflushed {
+		done <- err
+	}
+	s.wmu.Lock()
+	queue := s.wqueue
+	s.wqueue = nil
+	s.wstopped = true
+	s.werr = err
+	s.wmu.Unlock()
+	for _, req := range queue {
+		if req.done != nil {
+			req.done <- err
+		}
+	}
+}
+
+// resetStream sends RST_STREAM for id and fails the local stream, if any.
+func (s *Session) resetStream(id StreamId, status RstStreamStatus) {
+	s.queueFrame(&RstStreamFrame{StreamId: id, Status: status}, false)
+	s.metrics.StreamReset(status, false)
+	if st := s.removeStream(id); st != nil {
+		st.fail(&StreamResetError{id, status, false})
+	}
+}
+
+// streamError resets the stream e concerns with the status e maps to.
+func (s *Session) streamError(e *Error) {
+	s.resetStream(e.StreamId, e.RstStreamStatus())
+}
+
+// goAway sends GOAWAY once, after which the session accepts no new streams.
+func (s *Session) goAway(status GoAwayStatus) {
+	s.mu.Lock()
+	if s.goAwaySent || s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.goAwaySent = true
+	last := s.lastPeerId
+	s.mu.Unlock()
+	s.metrics.GoAway(status, false)
+	s.writeFrame(&GoAwayFrame{LastGoodStreamId: last, Status: status})
+}
+
+// protocolError ends the session after a session level error.
+func (s *Session) protocolError(err *Error) {
+	s.goAway(err.GoAwayStatus())
+	s.closeWithError(err)
+}
+
+func (s *Session) stream(id StreamId) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id StreamId) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.streams[id]
+	if st != nil {
+		delete(s.streams, id)
+		s.metrics.StreamClosed()
+	}
+	return st
+}
+
+// isPeerId reports whether id belongs to the peer's half of the id space.
+func (s *Session) isPeerId(id StreamId) bool {
+	return (id%2 == 1) == s.server
+}
+
+func (s *Session) readLoop() {
+	for {
+		frame, err := s.framer.ReadFrame()
+		if err != nil {
+			if !s.handleReadError(err) {
+				return
+			}
+			continue
+		}
+		switch frame := frame.(type) {
+		case *SynStreamFrame:
+			s.handleSynStream(frame)
+		case *SynReplyFrame:
+			s.handleSynReply(frame)
+		case *HeadersFrame:
+			s.handleHeaders(frame)
+		case *DataFrame:
+			s.handleData(frame)
+		case *RstStreamFrame:
+			s.metrics.StreamReset(frame.Status, true)
+			if st := s.removeStream(frame.StreamId); st != nil {
+				st.fail(&StreamResetError{frame.StreamId, frame.Status, true})
+			}
+		case *SettingsFrame:
+			s.handleSettings(frame)
+		case *PingFrame:
+			// Echo pings the peer started; wake whoever waits for
+			// replies to our own.
+			if (frame.Id%2 == 1) == s.server {
+				s.queueFrame(&PingFrame{Id: frame.Id}, false)
+			} else {
+				s.pingReply(frame.Id)
+			}
+		case *GoAwayFrame:
+			s.handleGoAway(frame)
+		case *WindowUpdateFrame:
+			s.handleWindowUpdate(frame)
+		}
+		if s.Err() != nil {
+			return
+		}
+	}
+}
+
+// handleReadError decides whether the session can survive err and reports
+// whether the read loop should carry on. Stream errors, found in a header
+// block that was read in full, only need that stream reset; anything else
+// leaves the framer out of step with the peer.
+func (s *Session) handleReadError(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		switch {
+		case e.Err == ReadFailed:
+			// The connection failed: there is no one to send GOAWAY to.
+			err = e.Cause
+		case e.Scope == ScopeStream && e.StreamId != 0:
+			s.streamError(e)
+			return true
+		default:
+			s.protocolError(e)
+			return false
+		}
+	}
+	if err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.closeWithError(err)
+	return false
+}
+
+func (s *Session) handleSynStream(frame *SynStreamFrame) {
+	id := frame.StreamId
+	s.mu.Lock()
+	if !s.isPeerId(id) || id <= s.lastPeerId {
+		inUse := s.streams[id] != nil
+		s.mu.Unlock()
+		if inUse {
+			s.resetStream(id, ProtocolError)
+		} else {
+			s.protocolError(&Error{Err: InvalidControlFrame, StreamId: id, FrameType: TypeSynStream})
+		}
+		return
+	}
+	s.lastPeerId = id
+	if s.goAwaySent {
+		s.mu.Unlock()
+		s.resetStream(id, RefusedStream)
+		return
+	}
+	st := newStream(s, id, s.initialWindow)
+	st.header = frame.Headers
+	st.replied = true
+	st.recvFin = frame.CFHeader.Flags&ControlFlagFin != 0
+	st.sendFin = frame.CFHeader.Flags&ControlFlagUnidirectional != 0
+	s.streams[id] = st
+	s.metrics.StreamOpened()
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+	default:
+		s.resetStream(id, RefusedStream)
+	}
+}
+
+func (s *Session) handleSynReply(frame *SynReplyFrame) {
+	st := s.stream(frame.StreamId)
+	if st == nil {
+		s.streamError(&Error{Err: StreamNotOpen, StreamId: frame.StreamId, FrameType: TypeSynReply, Scope: ScopeStream})
+		return
+	}
+	if !st.receiveReply(frame.Headers, frame.CFHeader.Flags&ControlFlagFin != 0) {
+		s.resetStream(frame.StreamId, StreamInUse)
+	}
+}
+
+func (s *Session) handleHeaders(frame *HeadersFrame) {
+	st := s.stream(frame.StreamId)
+	if st == nil {
+		s.streamError(&Error{Err: StreamNotOpen, StreamId: frame.StreamId, FrameType: TypeHeaders, Scope: ScopeStream})
+		return
+	}
+	if status := st.receiveHeaders(frame.Headers, frame.CFHeader.Flags&ControlFlagFin != 0); status != 0 {
+		s.resetStream(frame.StreamId, status)
+	}
+}
+
+func (s *Session) handleData(frame *DataFrame) {
+	st := s.stream(frame.StreamId)
+	if st == nil {
+		s.streamError(&Error{Err: StreamNotOpen, StreamId: frame.StreamId, Scope: ScopeStream})
+		return
+	}
+	switch status := st.receiveData(frame.Data, frame.Flags&DataFlagFin != 0); status {
+	case 0:
+	case FlowControlError:
+		s.streamError(&Error{Err: WindowExceeded, StreamId: frame.StreamId, Scope: ScopeStream})
+	default:
+		s.resetStream(frame.StreamId, status)
+	}
+}
+
+func (s *Session) handleSettings(frame *SettingsFrame) {
+	for _, v := range frame.FlagIdValues {
+		if v.Id != SettingsInitialWindowSize {
+			continue
+		}
+		// A window is at most 2^31-1 bytes; a larger one would wrap
+		// around to a negative window.
+		if v.Value > 1<<31-1 {
+			s.protocolError(&Error{Err: WindowExceeded, FrameType: TypeSettings})
+			return
+		}
+		s.mu.Lock()
+		delta := int32(v.Value) - s.initialWindow
+		s.initialWindow = int32(v.Value)
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+		for _, st := range streams {
+			if !st.growSendWindow(delta) {
+				s.streamError(&Error{Err: WindowExceeded, StreamId: st.id, FrameType: TypeSettings, Scope: ScopeStream})
+			}
+		}
+	}
+}
+
+func (s *Session) handleGoAway(frame *GoAwayFrame) {
+	s.metrics.GoAway(frame.Status, true)
+	s.mu.Lock()
+	s.goAwayRecv = true
+	var refused []*Stream
+	for id, st := range s.streams {
+		if st.local && id > frame.LastGoodStreamId {
+			refused = append(refused, st)
+			delete(s.streams, id)
+			s.metrics.StreamClosed()
+		}
+	}
+	s.mu.Unlock()
+	for _, st := range refused {
+		st.fail(ErrGoAway)
+	}
+}
+
+func (s *Session) handleWindowUpdate(frame *WindowUpdateFrame) {
+	st := s.stream(frame.StreamId)
+	if st == nil {
+		// The stream may have closed while the update was in flight.
+		return
+	}
+	if frame.DeltaWindowSize == 0 || frame.DeltaWindowSize > 1<<31-1 || !st.growSendWindow(int32(frame.DeltaWindowSize)) {
+		s.streamError(&Error{Err: WindowExceeded, StreamId: frame.StreamId, FrameType: TypeWindowUpdate, Scope: ScopeStream})
+	}
+}
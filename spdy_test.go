@@ -8,11 +8,18 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
 )
 
 var HeadersFixture = http.Header{
@@ -23,9 +30,11 @@ var HeadersFixture = http.Header{
 
 func TestHeaderParsing(t *testing.T) {
 	var headerValueBlockBuf bytes.Buffer
-	writeHeaderValueBlock(&headerValueBlockBuf, HeadersFixture)
 	const bogusStreamId = 1
-	newHeaders, err := parseHeaderValueBlock(&headerValueBlockBuf, bogusStreamId)
+	if _, err := writeHeaderValueBlock(&headerValueBlockBuf, HeadersFixture, bogusStreamId); err != nil {
+		t.Fatal("writeHeaderValueBlock:", err)
+	}
+	newHeaders, err := new(Framer).parseHeaderValueBlock(&headerValueBlockBuf, TypeHeaders, bogusStreamId)
 	if err != nil {
 		t.Fatal("parseHeaderValueBlock:", err)
 	}
@@ -34,6 +43,102 @@ func TestHeaderParsing(t *testing.T) {
 	}
 }
 
+// headerBlock is an http.Header that quick.Check fills with names and values
+// the header block encoding can represent.
+type headerBlock http.Header
+
+// headerRunes mixes in characters whose lowercase form has a different
+// UTF-8 length, such as the Kelvin sign.
+var headerRunes = []rune("abcXYZ-:0\u212a\u00e9 ")
+
+func randomHeaderString(rand *rand.Rand, min int) string {
+	r := make([]rune, min+rand.Intn(8))
+	for i := range r {
+		r[i] = headerRunes[rand.Intn(len(headerRunes))]
+	}
+	return string(r)
+}
+
+func (headerBlock) Generate(rand *rand.Rand, size int) reflect.Value {
+	h := make(headerBlock)
+	seen := make(map[string]bool)
+	for i := rand.Intn(size + 1); i > 0; i-- {
+		name := randomHeaderString(rand, 1)
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		values := []string{randomHeaderString(rand, 0)}
+		for j := rand.Intn(3); j > 0; j-- {
+			values = append(values, randomHeaderString(rand, 1))
+		}
+		if len(values) > 1 && values[0] == "" {
+			values[0] = "v"
+		}
+		h[name] = values
+	}
+	return reflect.ValueOf(h)
+}
+
+func TestHeaderValueBlockRoundTrip(t *testing.T) {
+	roundTrip := func(hb headerBlock) bool {
+		h := http.Header(hb)
+		var buf bytes.Buffer
+		n, err := writeHeaderValueBlock(&buf, h, 1)
+		if err != nil {
+			t.Log("writeHeaderValueBlock:", err)
+			return false
+		}
+		if n != buf.Len() {
+			t.Logf("writeHeaderValueBlock returned n=%d, wrote %d bytes", n, buf.Len())
+			return false
+		}
+		parsed, err := new(Framer).parseHeaderValueBlock(&buf, TypeHeaders, 1)
+		if err != nil {
+			t.Log("parseHeaderValueBlock:", err)
+			return false
+		}
+		want := make(http.Header, len(h))
+		for name, values := range h {
+			want[http.CanonicalHeaderKey(strings.ToLower(name))] = values
+		}
+		if !reflect.DeepEqual(want, parsed) || buf.Len() != 0 {
+			t.Log("got: ", parsed, "\nwant: ", want)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteInvalidHeaderValueBlock(t *testing.T) {
+	invalid := []struct {
+		h    http.Header
+		code ErrorCode
+	}{
+		{http.Header{"": {"a"}}, InvalidHeaderName},
+		{http.Header{"a\x00b": {"a"}}, InvalidHeaderName},
+		{http.Header{"Foo": {"a"}, "foo": {"b"}}, DuplicateHeaders},
+		{http.Header{"Foo": {}}, InvalidHeaderValue},
+		{http.Header{"Foo": {"a\x00b"}}, InvalidHeaderValue},
+		{http.Header{"Foo": {"a", ""}}, InvalidHeaderValue},
+		{http.Header{"Foo": {"", "a"}}, InvalidHeaderValue},
+	}
+	for _, tt := range invalid {
+		var buf bytes.Buffer
+		_, err := writeHeaderValueBlock(&buf, tt.h, 3)
+		eerr, ok := err.(*Error)
+		if !ok || eerr.Err != tt.code || eerr.StreamId != 3 {
+			t.Errorf("%q: got error %#v, want %q", tt.h, err, tt.code)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%q: wrote %d bytes for an invalid block", tt.h, buf.Len())
+		}
+	}
+}
+
 func TestCreateParseSynStreamFrameCompressionDisable(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	// Fixture framer for no compression test.
@@ -553,7 +658,8 @@ func TestMultipleSPDYFrames(t *testing.T) {
 
 func TestReadMalformedZlibHeader(t *testing.T) {
 	// These were constructed by corrupting the first byte of the zlib
-	// header after writing.
+	// header after writing. They were written as SPDY/2 frames, so their
+	// version is patched to 3 before reading.
 	malformedStructs := map[string]string{
 		"SynStreamFrame": "gAIAAQAAABgAAAACAAAAAAAAF/nfolGyYmAAAAAA//8=",
 		"SynReplyFrame":  "gAIAAgAAABQAAAACAAAX+d+iUbJiYAAAAAD//w==",
@@ -564,15 +670,76 @@ func TestReadMalformedZlibHeader(t *testing.T) {
 		if err != nil {
 			t.Errorf("Unable to decode base64 encoded frame %s: %v", name, err)
 		}
+		b[1] = Version
 		buf := bytes.NewBuffer(b)
 		reader, err := NewFramer(buf, buf)
 		if err != nil {
 			t.Fatalf("NewFramer: %v", err)
 		}
 		_, err = reader.ReadFrame()
-		if err != zlib.ErrHeader {
+		if !errors.Is(err, zlib.ErrHeader) || !errors.Is(err, ErrCorruptHeaderBlock) {
 			t.Errorf("Frame %s, expected: %#v, actual: %#v", name, zlib.ErrHeader, err)
 		}
+		if e, ok := err.(*Error); !ok || e.Scope != ScopeSession {
+			t.Errorf("Frame %s: got %#v, want a session error", name, err)
+		}
+	}
+}
+
+func TestErrorScopes(t *testing.T) {
+	var buf bytes.Buffer
+	framer, err := NewFramer(&buf, &buf)
+	if err != nil {
+		t.Fatalf("NewFramer: %v", err)
+	}
+	// A header SPDY/3 forbids spoils only its stream.
+	syn := &SynStreamFrame{StreamId: 3, Headers: http.Header{"connection": {"close"}}}
+	if err := framer.WriteFrame(syn); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	_, err = framer.ReadFrame()
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("ReadFrame: got %#v, want an *Error", err)
+	}
+	if !errors.Is(err, ErrInvalidHeaderPresent) || errors.Is(err, ErrZeroStreamId) {
+		t.Errorf("errors.Is matched the wrong sentinel for %v", err)
+	}
+	if e.Scope != ScopeStream || e.StreamId != 3 || e.FrameType != TypeSynStream {
+		t.Errorf("got scope %v, stream %d, type %v; want stream, 3, SYN_STREAM", e.Scope, e.StreamId, e.FrameType)
+	}
+	if e.RstStreamStatus() != ProtocolError {
+		t.Errorf("RstStreamStatus = %v, want %v", e.RstStreamStatus(), ProtocolError)
+	}
+
+	// A PING for id 0 is a session error.
+	buf.Reset()
+	buf.Write([]byte{0x80, 0x03, 0x00, 0x06, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00})
+	_, err = framer.ReadFrame()
+	if !errors.As(err, &e) || !errors.Is(err, ErrZeroStreamId) {
+		t.Fatalf("ReadFrame: got %#v, want ErrZeroStreamId", err)
+	}
+	if e.Scope != ScopeSession || e.FrameType != TypePing {
+		t.Errorf("got scope %v, type %v; want session, PING", e.Scope, e.FrameType)
+	}
+	if e.GoAwayStatus() != GoAwayProtocolError {
+		t.Errorf("GoAwayStatus = %v, want %v", e.GoAwayStatus(), GoAwayProtocolError)
+	}
+
+	// A header block cut short wraps the I/O error behind it.
+	buf.Reset()
+	if err := framer.WriteFrame(&HeadersFrame{StreamId: 3, Headers: HeadersFixture}); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	b := buf.Bytes()
+	b[7] -= 10 // shrink the length to cut the compressed block short
+	buf.Truncate(len(b) - 10)
+	_, err = framer.ReadFrame()
+	if !errors.Is(err, ErrWrongCompressedPayloadSize) && !errors.Is(err, ErrCorruptHeaderBlock) {
+		t.Fatalf("ReadFrame: got %#v, want a header block error", err)
+	}
+	if !errors.As(err, &e) || e.Scope != ScopeSession || e.Cause == nil || errors.Unwrap(err) != e.Cause {
+		t.Errorf("got %#v, want a session error wrapping its cause", err)
 	}
 }
 
@@ -642,3 +809,933 @@ func checkZeroStreamId(t *testing.T, frame string, method string, err error) {
 		t.Errorf("%s ZeroStreamId, incorrect error %#v, frame %s", method, eerr, frame)
 	}
 }
+
+func TestFrameHooks(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	var written, read []int
+	var compressed, decompressed [2]int
+	var errs []error
+	framer.SetHooks(&FrameHooks{
+		OnFrameWritten: func(frame Frame, n int) { written = append(written, n) },
+		OnFrameRead:    func(frame Frame, n int) { read = append(read, n) },
+		OnHeadersCompressed: func(id StreamId, uncompressed, wire int) {
+			compressed = [2]int{uncompressed, wire}
+		},
+		OnHeadersDecompressed: func(id StreamId, wire, uncompressed int) {
+			decompressed = [2]int{uncompressed, wire}
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+	})
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: HeadersFixture},
+		&PingFrame{Id: 1},
+		&DataFrame{StreamId: 1, Data: []byte("hello")},
+	}
+	var sizes []int
+	for _, frame := range frames {
+		before := buffer.Len()
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatal("WriteFrame:", err)
+		}
+		sizes = append(sizes, buffer.Len()-before)
+	}
+	for range frames {
+		if _, err := framer.ReadFrame(); err != nil {
+			t.Fatal("ReadFrame:", err)
+		}
+	}
+	if !reflect.DeepEqual(written, sizes) || !reflect.DeepEqual(read, sizes) {
+		t.Errorf("hooks saw %v written and %v read; want %v", written, read, sizes)
+	}
+	// The header block goes out compressed after the 18 fixed bytes.
+	if compressed[1] != sizes[0]-18 || compressed != decompressed {
+		t.Errorf("compressed %v, decompressed %v; want %d bytes on the wire", compressed, decompressed, sizes[0]-18)
+	}
+
+	if err := framer.WriteFrame(&PingFrame{Id: 0}); err == nil {
+		t.Fatal("WriteFrame of a zero ping id succeeded")
+	}
+	if _, err := framer.ReadFrame(); err != io.EOF {
+		t.Fatal("ReadFrame on an empty buffer returned", err)
+	}
+	if len(errs) != 2 || errs[1] != io.EOF {
+		t.Errorf("OnError saw %v; want the write error then io.EOF", errs)
+	}
+}
+
+func TestFrameString(t *testing.T) {
+	tests := []struct {
+		frame Frame
+		want  string
+	}{
+		{
+			&SynStreamFrame{
+				CFHeader: ControlFrameHeader{Flags: ControlFlagFin | ControlFlagUnidirectional},
+				StreamId: 1, Priority: 3,
+				Headers: http.Header{":method": {"GET"}, "Accept": {"a", "b"}},
+			},
+			`SYN_STREAM stream=1 assoc=0 pri=3 slot=0 flags=FIN|UNIDIRECTIONAL headers={:method="GET" accept="a","b"}`,
+		},
+		{
+			&SynReplyFrame{StreamId: 1, Headers: http.Header{":status": {"200 OK"}}},
+			`SYN_REPLY stream=1 flags=0 headers={:status="200 OK"}`,
+		},
+		{&RstStreamFrame{StreamId: 3, Status: Cancel}, "RST_STREAM stream=3 status=CANCEL"},
+		{&RstStreamFrame{StreamId: 3, Status: 99}, "RST_STREAM stream=3 status=UNKNOWN_STATUS(99)"},
+		{
+			&SettingsFrame{
+				CFHeader: ControlFrameHeader{Flags: ControlFlagSettingsClearSettings},
+				FlagIdValues: []SettingsFlagIdValue{
+					{FlagSettingsPersistValue, SettingsInitialWindowSize, 1024},
+					{0, SettingsMaxConcurrentStreams, 100},
+				},
+			},
+			"SETTINGS flags=CLEAR_SETTINGS values=[INITIAL_WINDOW_SIZE=1024(PERSIST_VALUE) MAX_CONCURRENT_STREAMS=100]",
+		},
+		{&PingFrame{Id: 7}, "PING id=7"},
+		{&GoAwayFrame{LastGoodStreamId: 5, Status: GoAwayProtocolError}, "GOAWAY last_good_stream=5 status=PROTOCOL_ERROR"},
+		{
+			&HeadersFrame{CFHeader: ControlFrameHeader{Flags: ControlFlagFin}, StreamId: 2, Headers: http.Header{}},
+			"HEADERS stream=2 flags=FIN headers={}",
+		},
+		{&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 4096}, "WINDOW_UPDATE stream=1 delta=4096"},
+		{&DataFrame{StreamId: 1, Flags: DataFlagFin | 0x04, Data: []byte("hello")}, "DATA stream=1 flags=FIN|0x04 length=5"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.frame); got != tt.want {
+			t.Errorf("got:  %s\nwant: %s", got, tt.want)
+		}
+	}
+}
+
+func TestDumpFrames(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: http.Header{":path": {"/"}}},
+		// The second header block only decodes with the first one's context.
+		&SynStreamFrame{StreamId: 3, Headers: http.Header{":path": {"/"}}},
+		&DataFrame{StreamId: 1, Flags: DataFlagFin, Data: []byte("x")},
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatal("WriteFrame:", err)
+		}
+	}
+	var out bytes.Buffer
+	if err := DumpFrames(buffer, &out); err != nil {
+		t.Fatal("DumpFrames:", err)
+	}
+	want := `SYN_STREAM stream=1 assoc=0 pri=0 slot=0 flags=0 headers={:path="/"}
+SYN_STREAM stream=3 assoc=0 pri=0 slot=0 flags=0 headers={:path="/"}
+DATA stream=1 flags=FIN length=1
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := DumpFrames(bytes.NewReader([]byte{0x80, 0x03, 0x00, 0x63, 0, 0, 0, 0}), &out); err == nil {
+		t.Error("DumpFrames of an unknown frame type succeeded")
+	}
+	if !strings.HasPrefix(out.String(), "error: ") {
+		t.Errorf("DumpFrames wrote %q; want the error", out.String())
+	}
+
+	// A version 2 PING is dumped after a warning.
+	out.Reset()
+	if err := DumpFrames(bytes.NewReader(pingV2), &out); err != nil {
+		t.Fatal("DumpFrames of a version 2 PING:", err)
+	}
+	if got := out.String(); !strings.HasPrefix(got, "warning: ") || !strings.HasSuffix(got, "\nPING id=1\n") {
+		t.Errorf("DumpFrames wrote %q; want a warning, then the PING", got)
+	}
+}
+
+// pingV2 is a PING frame of SPDY/2, which lenient mode reads as SPDY/3.
+var pingV2 = []byte{0x80, 2, 0, byte(TypePing), 0, 0, 0, 4, 0, 0, 0, 1}
+
+func TestFrameJSONRoundTrip(t *testing.T) {
+	frames := []Frame{
+		&SynStreamFrame{
+			CFHeader: ControlFrameHeader{Flags: ControlFlagFin},
+			StreamId: 1, AssociatedToStreamId: 2, Priority: 3, Slot: 4,
+			Headers: http.Header{":method": {"GET"}, "Accept": {"a", "b"}},
+		},
+		&SynReplyFrame{StreamId: 1, Headers: http.Header{":status": {"200 OK"}}},
+		&RstStreamFrame{StreamId: 3, Status: Cancel},
+		&RstStreamFrame{StreamId: 3, Status: 99},
+		&SettingsFrame{
+			CFHeader: ControlFrameHeader{Flags: ControlFlagSettingsClearSettings},
+			FlagIdValues: []SettingsFlagIdValue{
+				{FlagSettingsPersistValue, SettingsInitialWindowSize, 1024},
+				{0, 42, 100},
+			},
+		},
+		&PingFrame{Id: 7},
+		&GoAwayFrame{LastGoodStreamId: 5, Status: GoAwayProtocolError},
+		&HeadersFrame{CFHeader: ControlFrameHeader{Flags: ControlFlagFin}, StreamId: 2, Headers: http.Header{"X": {"y"}}},
+		&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 4096},
+		&DataFrame{StreamId: 1, Flags: DataFlagFin | 0x04, Data: []byte{0, 1, 0xff, '"'}},
+	}
+	for _, frame := range frames {
+		b, err := json.Marshal(frame)
+		if err != nil {
+			t.Errorf("Marshal %v: %v", frame, err)
+			continue
+		}
+		got, err := UnmarshalFrame(b)
+		if err != nil {
+			t.Errorf("UnmarshalFrame %s: %v", b, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, frame) {
+			t.Errorf("round trip of %s\ngot:  %#v\nwant: %#v", b, got, frame)
+		}
+	}
+}
+
+func TestUnmarshalFrameErrors(t *testing.T) {
+	for _, s := range []string{
+		`{"type":"NOOP"}`,
+		`{"type":"PING","id":"x"}`,
+		`{"type":"DATA","stream_id":1,"flags":["UNIDIRECTIONAL"],"data":""}`,
+		`{"type":"RST_STREAM","stream_id":1,"status":"BOGUS"}`,
+	} {
+		if frame, err := UnmarshalFrame([]byte(s)); err == nil {
+			t.Errorf("UnmarshalFrame(%s) = %v; want error", s, frame)
+		}
+	}
+	var ping PingFrame
+	if err := json.Unmarshal([]byte(`{"type":"GOAWAY"}`), &ping); err == nil {
+		t.Error("unmarshaled a GOAWAY frame into a PingFrame")
+	}
+}
+
+// TestTranscriptGolden encodes the frames of testdata/frames.json and
+// decodes them again, which must give back the file unchanged.
+func TestTranscriptGolden(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/frames.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire, transcript bytes.Buffer
+	if err := TranscriptToWire(&wire, bytes.NewReader(golden)); err != nil {
+		t.Fatal("TranscriptToWire:", err)
+	}
+	if err := WireToTranscript(&transcript, &wire, nil); err != nil {
+		t.Fatal("WireToTranscript:", err)
+	}
+	if transcript.String() != string(golden) {
+		t.Errorf("got:\n%s\nwant:\n%s", transcript.String(), golden)
+	}
+
+	// A violation is reported as a warning, and the frame still decoded.
+	transcript.Reset()
+	var warnings []*Error
+	err = WireToTranscript(&transcript, bytes.NewReader(pingV2), func(e *Error) {
+		warnings = append(warnings, e)
+	})
+	if err != nil {
+		t.Fatal("WireToTranscript of a version 2 PING:", err)
+	}
+	if len(warnings) != 1 || !errors.Is(warnings[0], ErrUnsupportedFrameVersion) {
+		t.Errorf("warnings %v; want one UnsupportedFrameVersion", warnings)
+	}
+	frames, err := ReadTranscript(&transcript)
+	if err != nil {
+		t.Fatal("ReadTranscript:", err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("transcript holds %v; want the PING", frames)
+	}
+	if ping, ok := frames[0].(*PingFrame); !ok || ping.Id != 1 {
+		t.Errorf("transcript holds %v; want PING 1", frames[0])
+	}
+}
+
+// benchmarkFrames holds one frame of each type.
+var benchmarkFrames = []struct {
+	name  string
+	frame Frame
+}{
+	{"SynStream", &SynStreamFrame{StreamId: 1, Priority: 3, Headers: HeadersFixture}},
+	{"SynReply", &SynReplyFrame{StreamId: 1, Headers: HeadersFixture}},
+	{"RstStream", &RstStreamFrame{StreamId: 1, Status: Cancel}},
+	{"Settings", &SettingsFrame{FlagIdValues: []SettingsFlagIdValue{
+		{0, SettingsMaxConcurrentStreams, 100},
+		{0, SettingsInitialWindowSize, 1 << 20},
+	}}},
+	{"Ping", &PingFrame{Id: 1}},
+	{"GoAway", &GoAwayFrame{LastGoodStreamId: 7, Status: GoAwayOK}},
+	{"Headers", &HeadersFrame{StreamId: 1, Headers: HeadersFixture}},
+	{"WindowUpdate", &WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 1 << 16}},
+	{"Data", &DataFrame{StreamId: 1, Data: make([]byte, 1024)}},
+}
+
+func BenchmarkWriteFrame(b *testing.B) {
+	for _, bf := range benchmarkFrames {
+		b.Run(bf.name, func(b *testing.B) {
+			framer, err := NewFramer(ioutil.Discard, nil)
+			if err != nil {
+				b.Fatal("NewFramer:", err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := framer.WriteFrame(bf.frame); err != nil {
+					b.Fatal("WriteFrame:", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	for _, bf := range benchmarkFrames {
+		b.Run(bf.name, func(b *testing.B) {
+			// Header blocks share a compression context, so every frame
+			// read has to have been encoded in turn. They are encoded in
+			// batches, to bound the memory the benchmark takes.
+			const batch = 1024
+			var buf bytes.Buffer
+			w, err := NewFramer(&buf, nil)
+			if err != nil {
+				b.Fatal("NewFramer:", err)
+			}
+			r := new(bytes.Reader)
+			framer, err := NewFramer(nil, r)
+			if err != nil {
+				b.Fatal("NewFramer:", err)
+			}
+			if err := w.WriteFrame(bf.frame); err != nil {
+				b.Fatal("WriteFrame:", err)
+			}
+			b.SetBytes(int64(buf.Len()))
+			r.Reset(buf.Bytes())
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if r.Len() == 0 {
+					b.StopTimer()
+					buf.Reset()
+					for j := 0; j < batch && j < b.N-i; j++ {
+						if err := w.WriteFrame(bf.frame); err != nil {
+							b.Fatal("WriteFrame:", err)
+						}
+					}
+					r.Reset(buf.Bytes())
+					b.StartTimer()
+				}
+				if _, err := framer.ReadFrame(); err != nil {
+					b.Fatal("ReadFrame:", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAppendParseFrame(t *testing.T) {
+	appender, err := NewFramer(nil, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	b := []byte("prefix")
+	var sizes []int
+	for _, bf := range benchmarkFrames {
+		before := len(b)
+		if b, err = appender.AppendFrame(b, bf.frame); err != nil {
+			t.Fatalf("AppendFrame(%s): %v", bf.name, err)
+		}
+		sizes = append(sizes, len(b)-before)
+	}
+	if !bytes.HasPrefix(b, []byte("prefix")) {
+		t.Fatalf("AppendFrame overwrote dst: %q", b)
+	}
+	if b2, err := appender.AppendFrame(b, &PingFrame{}); err == nil || len(b2) != len(b) {
+		t.Errorf("AppendFrame of an invalid frame returned %d bytes, %v; want dst and an error", len(b2), err)
+	}
+
+	parser, err := NewFramer(nil, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	b = b[len("prefix"):]
+	for i, bf := range benchmarkFrames {
+		// A partial frame is left for later, without disturbing the
+		// decompression context.
+		for _, short := range []int{0, 7, sizes[i] - 1} {
+			if _, n, err := parser.ParseFrame(b[:short]); n != 0 || err != io.ErrUnexpectedEOF {
+				t.Fatalf("ParseFrame(%s) of %d bytes returned n=%d, %v", bf.name, short, n, err)
+			}
+		}
+		frame, n, err := parser.ParseFrame(b)
+		if err != nil {
+			t.Fatalf("ParseFrame(%s): %v", bf.name, err)
+		}
+		if !reflect.DeepEqual(frame, bf.frame) {
+			t.Errorf("ParseFrame(%s) = %v; want %v", bf.name, frame, bf.frame)
+		}
+		if n != sizes[i] {
+			t.Errorf("ParseFrame(%s) consumed %d bytes; want %d", bf.name, n, sizes[i])
+		}
+		b = b[n:]
+	}
+	if len(b) != 0 {
+		t.Errorf("%d bytes left over", len(b))
+	}
+
+	// Both encoders, and both decoders, share one compression context.
+	var wire bytes.Buffer
+	mixed, err := NewFramer(&wire, &wire)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	for i, bf := range benchmarkFrames {
+		if i%2 == 0 {
+			err = mixed.WriteFrame(bf.frame)
+		} else {
+			b, err = mixed.AppendFrame(b[:0], bf.frame)
+			wire.Write(b)
+		}
+		if err != nil {
+			t.Fatalf("encoding %s: %v", bf.name, err)
+		}
+	}
+	for i, bf := range benchmarkFrames {
+		var frame Frame
+		if i%2 == 0 {
+			frame, err = mixed.ReadFrame()
+		} else {
+			var n int
+			frame, n, err = mixed.ParseFrame(wire.Bytes())
+			wire.Next(n)
+		}
+		if err != nil || !reflect.DeepEqual(frame, bf.frame) {
+			t.Errorf("decoding %s: got %v, %v", bf.name, frame, err)
+		}
+	}
+}
+
+func TestParserSplits(t *testing.T) {
+	var wire bytes.Buffer
+	framer, err := NewFramer(&wire, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	// Two rounds, so that later header blocks depend on earlier ones.
+	for round := 0; round < 2; round++ {
+		for _, bf := range benchmarkFrames {
+			if err := framer.WriteFrame(bf.frame); err != nil {
+				t.Fatalf("WriteFrame(%s): %v", bf.name, err)
+			}
+		}
+	}
+	b := wire.Bytes()
+	reader, err := NewFramer(nil, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	var want []Frame
+	for len(want) < 2*len(benchmarkFrames) {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal("ReadFrame:", err)
+		}
+		want = append(want, frame)
+	}
+
+	check := func(desc string, chunks ...[]byte) {
+		t.Helper()
+		p, err := NewParser(nil)
+		if err != nil {
+			t.Fatal("NewParser:", err)
+		}
+		for _, chunk := range chunks {
+			if err := p.Feed(chunk); err != nil {
+				t.Fatalf("%s: Feed: %v", desc, err)
+			}
+		}
+		var got []Frame
+		for frame, ok := p.Next(); ok; frame, ok = p.Next() {
+			got = append(got, frame)
+		}
+		if !reflect.DeepEqual(got, want) || p.Buffered() != 0 {
+			t.Fatalf("%s: got %d frames with %d bytes left; want %d frames", desc, len(got), p.Buffered(), len(want))
+		}
+	}
+	for i := 0; i <= len(b); i++ {
+		check(fmt.Sprintf("split at %d", i), b[:i], b[i:])
+	}
+	bytewise := make([][]byte, len(b))
+	for i := range b {
+		bytewise[i] = b[i : i+1]
+	}
+	check("one byte at a time", bytewise...)
+}
+
+func TestParserCallback(t *testing.T) {
+	var wire bytes.Buffer
+	framer, err := NewFramer(&wire, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	framer.WriteFrame(&PingFrame{Id: 1})
+	framer.WriteFrame(&PingFrame{Id: 3})
+	stop := errors.New("stop")
+	var got []uint32
+	p, err := NewParser(func(frame Frame) error {
+		got = append(got, frame.(*PingFrame).Id)
+		return stop
+	})
+	if err != nil {
+		t.Fatal("NewParser:", err)
+	}
+	if err := p.Feed(wire.Bytes()); err != stop {
+		t.Fatalf("Feed returned %v; want the callback's error", err)
+	}
+	if err := p.Feed(nil); err != stop || !reflect.DeepEqual(got, []uint32{1, 3}) {
+		t.Errorf("Feed returned %v after frames %v; want frames [1 3]", err, got)
+	}
+
+	p, _ = NewParser(nil)
+	bad := []byte{0x80, 3, 0, 6, 0, 0, 0, 4, 0, 0, 0, 0} // PING with id 0
+	if err := p.Feed(bad); err == nil {
+		t.Fatal("Feed of a malformed frame succeeded")
+	}
+	if err := p.Feed(nil); err == nil {
+		t.Error("Feed after a malformed frame succeeded")
+	}
+}
+
+func TestParserStreamError(t *testing.T) {
+	var wire bytes.Buffer
+	framer, err := NewFramer(&wire, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	// A SYN_STREAM carrying a header SPDY/3 forbids, and a DATA frame for
+	// stream 0, each spoil only themselves.
+	framer.WriteFrame(&SynStreamFrame{StreamId: 1, Headers: http.Header{"connection": {"close"}}})
+	wire.Write([]byte{0, 0, 0, 0, 0, 0, 0, 1, 'x'})
+	framer.WriteFrame(&SynStreamFrame{StreamId: 3, Headers: http.Header{"x": {"y"}}})
+	p, err := NewParser(nil)
+	if err != nil {
+		t.Fatal("NewParser:", err)
+	}
+	if err := p.Feed(wire.Bytes()); !errors.Is(err, ErrInvalidHeaderPresent) {
+		t.Fatalf("Feed returned %v; want %v", err, ErrInvalidHeaderPresent)
+	}
+	if err := p.Feed(nil); !errors.Is(err, ErrZeroStreamId) {
+		t.Fatalf("second Feed returned %v; want %v", err, ErrZeroStreamId)
+	}
+	if err := p.Feed(nil); err != nil {
+		t.Fatalf("third Feed: %v", err)
+	}
+	frame, ok := p.Next()
+	if syn, _ := frame.(*SynStreamFrame); !ok || syn.StreamId != 3 || syn.Headers.Get("x") != "y" {
+		t.Errorf("Next() = %v, %v; want the SYN_STREAM for stream 3", frame, ok)
+	}
+}
+
+func TestReadFrameHeader(t *testing.T) {
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Headers: HeadersFixture},
+		&DataFrame{StreamId: 1, Flags: DataFlagFin, Data: []byte("passed through")},
+		&PingFrame{Id: 2},
+		&HeadersFrame{CFHeader: ControlFrameHeader{Flags: ControlFlagFin}, StreamId: 1, Headers: HeadersFixture},
+		&WindowUpdateFrame{StreamId: 3, DeltaWindowSize: 10},
+		&DataFrame{StreamId: 3, Data: []byte("decoded")},
+	}
+	var wire bytes.Buffer
+	writer, err := NewFramer(&wire, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	for _, frame := range frames {
+		if err := writer.WriteFrame(frame); err != nil {
+			t.Fatal("WriteFrame:", err)
+		}
+	}
+	raw := append([]byte(nil), wire.Bytes()...)
+
+	// Pass the first DATA frame on unread and decode the rest.
+	var forwarded bytes.Buffer
+	reader, err := NewFramer(nil, &wire)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	want := []FrameHeader{
+		{Control: true, Version: Version, Type: TypeSynStream, StreamId: 1},
+		{StreamId: 1, Flags: uint8(DataFlagFin), Length: 14},
+		{Control: true, Version: Version, Type: TypePing, Length: 4},
+		{Control: true, Version: Version, Type: TypeHeaders, Flags: uint8(ControlFlagFin), StreamId: 1},
+		{Control: true, Version: Version, Type: TypeWindowUpdate, Length: 8, StreamId: 3},
+		{StreamId: 3, Length: 7},
+	}
+	for i, frame := range frames {
+		h, err := reader.ReadFrameHeader()
+		if err != nil {
+			t.Fatalf("frame %d: ReadFrameHeader: %v", i, err)
+		}
+		got := h
+		got.read = 0
+		if want[i].Length == 0 {
+			got.Length = 0 // depends on compression
+		}
+		if got != want[i] {
+			t.Errorf("frame %d: header %+v; want %+v", i, got, want[i])
+		}
+		if i == 1 {
+			forwarded.Write(h.Append(nil))
+			if _, err := io.CopyN(&forwarded, &wire, int64(h.BodyLength())); err != nil {
+				t.Fatal("CopyN:", err)
+			}
+			continue
+		}
+		decoded, err := reader.ReadFrameBody(h)
+		if err != nil {
+			t.Fatalf("frame %d: ReadFrameBody: %v", i, err)
+		}
+		if !reflect.DeepEqual(decoded, frame) {
+			t.Errorf("frame %d: decoded %v; want %v", i, decoded, frame)
+		}
+	}
+	if off := WireSize(frames[0]); !bytes.Equal(forwarded.Bytes(), raw[off:off+8+14]) {
+		t.Errorf("forwarded %q; want the DATA frame as sent", forwarded.Bytes())
+	}
+
+	// Passing DATA frames through allocates nothing.
+	wire.Reset()
+	for i := 0; i < 20; i++ {
+		writer.WriteFrame(&DataFrame{StreamId: 1, Data: make([]byte, 100)})
+	}
+	r := bytes.NewReader(wire.Bytes())
+	reader, _ = NewFramer(nil, r)
+	allocs := testing.AllocsPerRun(10, func() {
+		h, err := reader.ReadFrameHeader()
+		if err != nil {
+			t.Fatal("ReadFrameHeader:", err)
+		}
+		r.Seek(int64(h.BodyLength()), io.SeekCurrent)
+	})
+	if allocs != 0 {
+		t.Errorf("ReadFrameHeader made %v allocations; want 0", allocs)
+	}
+}
+
+func TestReadFrameHeaderShort(t *testing.T) {
+	var wire bytes.Buffer
+	// A RST_STREAM frame two bytes long, too short for its stream ID.
+	wire.Write([]byte{0x80, Version, 0, byte(TypeRstStream), 0, 0, 0, 2, 0, 1})
+	writer, err := NewFramer(&wire, nil)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	if err := writer.WriteFrame(&PingFrame{Id: 1}); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	reader, err := NewFramer(nil, &wire)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	h, err := reader.ReadFrameHeader()
+	if !errors.Is(err, ErrInvalidFrameLength) {
+		t.Fatalf("ReadFrameHeader returned %v; want InvalidFrameLength", err)
+	}
+	if n := h.BodyLength(); n != 0 {
+		t.Errorf("BodyLength = %d; want 0", n)
+	}
+	h, err = reader.ReadFrameHeader()
+	if err != nil {
+		t.Fatal("ReadFrameHeader after the short frame:", err)
+	}
+	frame, err := reader.ReadFrameBody(h)
+	if err != nil {
+		t.Fatal("ReadFrameBody:", err)
+	}
+	if ping, ok := frame.(*PingFrame); !ok || ping.Id != 1 {
+		t.Errorf("read %v after the short frame; want PING 1", frame)
+	}
+}
+
+func TestControlFrameHeaderAccessors(t *testing.T) {
+	var wire bytes.Buffer
+	framer, err := NewFramer(&wire, &wire)
+	if err != nil {
+		t.Fatal("NewFramer:", err)
+	}
+	frames := []Frame{
+		&SynReplyFrame{StreamId: 1, Headers: HeadersFixture},
+		&GoAwayFrame{LastGoodStreamId: 1},
+		&DataFrame{StreamId: 1, Data: []byte("abc")},
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatal("WriteFrame:", err)
+		}
+		n := wire.Len()
+		if size := WireSize(frame); size != n {
+			t.Errorf("WireSize(%v) after writing = %d; want %d", frame, size, n)
+		}
+		got, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal("ReadFrame:", err)
+		}
+		if size := WireSize(got); size != n {
+			t.Errorf("WireSize(%v) after reading = %d; want %d", got, size, n)
+		}
+	}
+
+	h := frames[1].(*GoAwayFrame).CFHeader
+	if h.Version() != Version || h.Type() != TypeGoAway || h.Length() != 8 {
+		t.Errorf("GOAWAY header reports version %d, type %v, length %d", h.Version(), h.Type(), h.Length())
+	}
+	if built := NewControlFrameHeader(Version, TypeGoAway, 0, 8); built != h {
+		t.Errorf("NewControlFrameHeader = %+v; want %+v", built, h)
+	}
+}
+
+// rawControlFrame returns a control frame of type t with flags and payload
+// written as is.
+func rawControlFrame(t ControlFrameType, flags byte, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, 0x80000000|Version<<16|uint32(t))
+	binary.BigEndian.PutUint32(b[4:], uint32(flags)<<24|uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestParseModes(t *testing.T) {
+	// An uncompressed header block naming Foo and then foo.
+	block := []byte{0, 0, 0, 2,
+		0, 0, 0, 3, 'F', 'o', 'o', 0, 0, 0, 1, 'a',
+		0, 0, 0, 3, 'f', 'o', 'o', 0, 0, 0, 1, 'b'}
+	tests := []struct {
+		name  string
+		wire  []byte
+		codes []ErrorCode // violations, in the order they are found
+		want  Frame       // the frame read in lenient mode
+	}{
+		{
+			name:  "version 2",
+			wire:  append([]byte{0x80, 0x02}, rawControlFrame(TypePing, 0, []byte{0, 0, 0, 1})[2:]...),
+			codes: []ErrorCode{UnsupportedFrameVersion},
+			want: &PingFrame{
+				CFHeader: ControlFrameHeader{2, TypePing, 0, 4},
+				Id:       1,
+			},
+		},
+		{
+			name:  "version 4 with flags",
+			wire:  append([]byte{0x80, 0x04}, rawControlFrame(TypeRstStream, 0x01, []byte{0, 0, 0, 1, 0, 0, 0, 5})[2:]...),
+			codes: []ErrorCode{UnsupportedFrameVersion, InvalidFlags},
+			want: &RstStreamFrame{
+				CFHeader: ControlFrameHeader{4, TypeRstStream, 0x01, 8},
+				StreamId: 1,
+				Status:   Cancel,
+			},
+		},
+		{
+			name:  "ping flags",
+			wire:  rawControlFrame(TypePing, 0x01, []byte{0, 0, 0, 1}),
+			codes: []ErrorCode{InvalidFlags},
+			want: &PingFrame{
+				CFHeader: ControlFrameHeader{Version, TypePing, 0x01, 4},
+				Id:       1,
+			},
+		},
+		{
+			name:  "window update reserved bits",
+			wire:  rawControlFrame(TypeWindowUpdate, 0, []byte{0x80, 0, 0, 1, 0x80, 0, 0, 2}),
+			codes: []ErrorCode{ReservedBitSet},
+			want: &WindowUpdateFrame{
+				CFHeader:        ControlFrameHeader{Version, TypeWindowUpdate, 0, 8},
+				StreamId:        1,
+				DeltaWindowSize: 2,
+			},
+		},
+		{
+			name:  "data flags",
+			wire:  []byte{0, 0, 0, 1, 0x03, 0, 0, 1, 'x'},
+			codes: []ErrorCode{InvalidFlags},
+			want:  &DataFrame{StreamId: 1, Flags: 0x03, Data: []byte("x")},
+		},
+		{
+			name:  "header names and reserved bit",
+			wire:  rawControlFrame(TypeHeaders, 0, append([]byte{0x80, 0, 0, 1}, block...)),
+			codes: []ErrorCode{UnlowercasedHeaderName, DuplicateHeaders, ReservedBitSet},
+			want: &HeadersFrame{
+				CFHeader: ControlFrameHeader{Version, TypeHeaders, 0, uint32(4 + len(block))},
+				StreamId: 1,
+				Headers:  http.Header{"Foo": {"a", "b"}},
+			},
+		},
+	}
+	newFramer := func(wire []byte) *Framer {
+		return &Framer{headerCompressionDisabled: true, r: bytes.NewReader(wire)}
+	}
+	for _, tt := range tests {
+		// Strict mode fails on the first violation.
+		_, err := newFramer(tt.wire).ReadFrame()
+		if !errors.Is(err, &Error{Err: tt.codes[0]}) {
+			t.Errorf("%s: strict ReadFrame error = %v, want %q", tt.name, err, tt.codes[0])
+		}
+
+		// Lenient mode reads the frame and warns about each violation.
+		framer := newFramer(tt.wire)
+		framer.SetParseMode(ParseLenient)
+		var codes []ErrorCode
+		framer.SetHooks(&FrameHooks{OnWarning: func(e *Error) {
+			codes = append(codes, e.Err)
+		}})
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Errorf("%s: lenient ReadFrame: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(frame, tt.want) {
+			t.Errorf("%s: lenient ReadFrame = %#v, want %#v", tt.name, frame, tt.want)
+		}
+		if !reflect.DeepEqual(codes, tt.codes) {
+			t.Errorf("%s: warnings = %q, want %q", tt.name, codes, tt.codes)
+		}
+	}
+}
+
+func TestControlFrameRules(t *testing.T) {
+	// An uncompressed header block with no headers.
+	block := []byte{0, 0, 0, 0}
+	tests := []struct {
+		frameType ControlFrameType
+		payload   []byte // a well formed payload
+		flags     byte   // all the flags the type allows
+	}{
+		{TypeSynStream, append([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0}, block...), 0x03},
+		{TypeSynReply, append([]byte{0, 0, 0, 1}, block...), 0x01},
+		{TypeRstStream, []byte{0, 0, 0, 1, 0, 0, 0, 1}, 0},
+		{TypeSettings, []byte{0, 0, 0, 1, 0, 0, 0, 4, 0, 0, 0, 100}, 0x01},
+		{TypePing, []byte{0, 0, 0, 1}, 0},
+		{TypeGoAway, []byte{0, 0, 0, 1, 0, 0, 0, 0}, 0},
+		{TypeHeaders, append([]byte{0, 0, 0, 1}, block...), 0x01},
+		{TypeWindowUpdate, []byte{0, 0, 0, 1, 0, 0, 0, 1}, 0},
+	}
+	// Each frame is followed by a PING, which must still be read.
+	next := rawControlFrame(TypePing, 0, []byte{0, 0, 0, 7})
+	read := func(wire []byte, mode ParseMode) (Frame, []ErrorCode, error) {
+		framer := &Framer{headerCompressionDisabled: true, r: bytes.NewReader(append(wire, next...))}
+		framer.SetParseMode(mode)
+		var codes []ErrorCode
+		framer.SetHooks(&FrameHooks{OnWarning: func(e *Error) {
+			codes = append(codes, e.Err)
+		}})
+		frame, err := framer.ReadFrame()
+		if ping, perr := framer.ReadFrame(); perr != nil || ping.(*PingFrame).Id != 7 {
+			t.Errorf("%v: next frame = %v, %v; want PING 7", wire, ping, perr)
+		}
+		return frame, codes, err
+	}
+	for _, tt := range tests {
+		name := tt.frameType.String()
+		if _, _, err := read(rawControlFrame(tt.frameType, tt.flags, tt.payload), ParseStrict); err != nil {
+			t.Errorf("%s: ReadFrame: %v", name, err)
+		}
+
+		badFlags := rawControlFrame(tt.frameType, tt.flags+0x04, tt.payload)
+		_, _, err := read(badFlags, ParseStrict)
+		if e, ok := err.(*Error); !ok || e.Err != InvalidFlags || e.FrameType != tt.frameType {
+			t.Errorf("%s: flags %#x: ReadFrame error = %#v, want InvalidFlags", name, tt.flags+0x04, err)
+		}
+		if _, codes, err := read(badFlags, ParseLenient); err != nil || !reflect.DeepEqual(codes, []ErrorCode{InvalidFlags}) {
+			t.Errorf("%s: lenient, flags %#x: got %v and warnings %q", name, tt.flags+0x04, err, codes)
+		}
+
+		short := rawControlFrame(tt.frameType, 0, tt.payload[:len(tt.payload)-1])
+		for _, mode := range []ParseMode{ParseStrict, ParseLenient} {
+			if _, _, err := read(short, mode); !errors.Is(err, ErrInvalidFrameLength) {
+				t.Errorf("%s: %v, length %d: ReadFrame error = %v, want %v", name, mode, len(tt.payload)-1, err, ErrInvalidFrameLength)
+			}
+		}
+
+		long := rawControlFrame(tt.frameType, 0, append(tt.payload, 0, 0, 0, 0))
+		if _, _, err := read(long, ParseStrict); !errors.Is(err, ErrInvalidFrameLength) {
+			t.Errorf("%s: length %d: ReadFrame error = %v, want %v", name, len(tt.payload)+4, err, ErrInvalidFrameLength)
+		}
+		frame, codes, err := read(long, ParseLenient)
+		if err != nil || !reflect.DeepEqual(codes, []ErrorCode{InvalidFrameLength}) {
+			t.Errorf("%s: lenient, length %d: got %v and warnings %q", name, len(tt.payload)+4, err, codes)
+		} else if WireSize(frame) != len(long) {
+			t.Errorf("%s: lenient, length %d: WireSize = %d, want %d", name, len(tt.payload)+4, WireSize(frame), len(long))
+		}
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	tests := []struct {
+		code   ErrorCode
+		rst    RstStreamStatus
+		goAway GoAwayStatus
+	}{
+		{ZeroStreamId, ProtocolError, GoAwayProtocolError},
+		{HeaderBlockTooLarge, FrameTooLarge, GoAwayProtocolError},
+		{StreamNotOpen, InvalidStream, GoAwayProtocolError},
+		{UnsupportedFrameVersion, UnsupportedVersion, GoAwayProtocolError},
+		{WindowExceeded, FlowControlError, GoAwayProtocolError},
+		{CorruptHeaderBlock, InternalError, GoAwayInternalError},
+		{ReadFailed, InternalError, GoAwayInternalError},
+	}
+	for _, tt := range tests {
+		e := &Error{Err: tt.code}
+		if got := e.RstStreamStatus(); got != tt.rst {
+			t.Errorf("%q: RstStreamStatus = %v, want %v", tt.code, got, tt.rst)
+		}
+		if got := e.GoAwayStatus(); got != tt.goAway {
+			t.Errorf("%q: GoAwayStatus = %v, want %v", tt.code, got, tt.goAway)
+		}
+	}
+}
+
+func TestReadFailed(t *testing.T) {
+	var buf bytes.Buffer
+	framer, err := NewFramer(&buf, &buf)
+	if err != nil {
+		t.Fatalf("NewFramer: %v", err)
+	}
+	if err := framer.WriteFrame(&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 1}); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+	whole := buf.Len()
+	for _, n := range []int{whole - 2, 3} {
+		framer, err := NewFramer(nil, bytes.NewReader(buf.Bytes()[:n]))
+		if err != nil {
+			t.Fatalf("NewFramer: %v", err)
+		}
+		_, err = framer.ReadFrame()
+		var e *Error
+		if !errors.As(err, &e) || e.Err != ReadFailed || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d of %d bytes: ReadFrame error = %#v, want ReadFailed wrapping io.ErrUnexpectedEOF", n, whole, err)
+		}
+	}
+	framer, err = NewFramer(nil, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("NewFramer: %v", err)
+	}
+	if _, err := framer.ReadFrame(); err != io.EOF {
+		t.Errorf("no input: ReadFrame error = %v, want io.EOF", err)
+	}
+}
+
+func TestHeaderBlockTooLarge(t *testing.T) {
+	wire := rawControlFrame(TypeHeaders, 0, []byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+	framer := &Framer{headerCompressionDisabled: true, r: bytes.NewReader(wire)}
+	_, err := framer.ReadFrame()
+	var e *Error
+	if !errors.As(err, &e) || e.Err != HeaderBlockTooLarge || e.RstStreamStatus() != FrameTooLarge {
+		t.Errorf("ReadFrame error = %#v, want HeaderBlockTooLarge", err)
+	}
+}
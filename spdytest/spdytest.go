@@ -0,0 +1,223 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package spdytest provides a scriptable SPDY peer for testing code built on
+// the spdy package without real sockets.
+//
+// A test connects the code under test to a Peer and then plays the other
+// side of the conversation frame by frame:
+//
+//	conn, peer := spdytest.NewPair(t)
+//	s, _ := spdy.NewSession(conn, false)
+//	st, _ := s.OpenStream(h, true)
+//	peer.Expect(&spdy.SynStreamFrame{StreamId: 1, ...})
+//	peer.Send(&spdy.SynReplyFrame{StreamId: 1, ...})
+//
+// Peer methods report failures through the testing.TB they were created
+// with, so they must be called from the goroutine running the test.
+package spdytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+// DefaultTimeout is the Timeout of new Peers.
+const DefaultTimeout = 5 * time.Second
+
+// A Peer is one end of a SPDY connection driven by a test. It has its own
+// Framer, and so its own header compression contexts.
+type Peer struct {
+	// Timeout limits how long the peer waits for each frame it expects
+	// and for the code under test to take each frame it sends.
+	Timeout time.Duration
+
+	tb     testing.TB
+	conn   net.Conn
+	bw     *bufio.Writer
+	framer *spdy.Framer
+	frames chan spdy.Frame
+	err    error // why frames was closed; valid once it is
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewPair returns one end of an in-memory connection for the code under
+// test, and a Peer on the other end. The connection is closed when the
+// test finishes.
+func NewPair(tb testing.TB) (net.Conn, *Peer) {
+	c, pc := net.Pipe()
+	tb.Cleanup(func() { c.Close() })
+	return c, NewPeer(tb, pc)
+}
+
+// NewPeer returns a Peer speaking on conn. The peer closes conn when the
+// test finishes.
+func NewPeer(tb testing.TB, conn net.Conn) *Peer {
+	tb.Helper()
+	bw := bufio.NewWriter(conn)
+	framer, err := spdy.NewFramer(bw, bufio.NewReader(conn))
+	if err != nil {
+		tb.Fatal("spdytest: NewFramer:", err)
+	}
+	p := &Peer{
+		Timeout: DefaultTimeout,
+		tb:      tb,
+		conn:    conn,
+		bw:      bw,
+		framer:  framer,
+		frames:  make(chan spdy.Frame, 64),
+		closed:  make(chan struct{}),
+	}
+	go p.readLoop()
+	tb.Cleanup(func() { p.Close() })
+	return p
+}
+
+// readLoop reads frames ahead, so that a timeout never leaves the Framer
+// in the middle of a frame.
+func (p *Peer) readLoop() {
+	for {
+		frame, err := p.framer.ReadFrame()
+		if err != nil {
+			p.err = err
+			close(p.frames)
+			return
+		}
+		select {
+		case p.frames <- frame:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// Close closes the peer's end of the connection.
+func (p *Peer) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return p.conn.Close()
+}
+
+// Send writes frames to the code under test, failing the test if they are
+// not taken within the timeout.
+func (p *Peer) Send(frames ...spdy.Frame) {
+	p.tb.Helper()
+	p.conn.SetWriteDeadline(time.Now().Add(p.Timeout))
+	defer p.conn.SetWriteDeadline(time.Time{})
+	for _, frame := range frames {
+		if err := p.framer.WriteFrame(frame); err != nil {
+			p.tb.Fatalf("spdytest: sending %v: %v", frame, err)
+		}
+	}
+	if err := p.bw.Flush(); err != nil {
+		p.tb.Fatalf("spdytest: sending frames: %v", err)
+	}
+}
+
+// Next returns the next frame from the code under test. It fails the test
+// if none arrives within the timeout or the connection fails.
+func (p *Peer) Next() spdy.Frame {
+	p.tb.Helper()
+	frame, err := p.next()
+	if err != nil {
+		p.tb.Fatalf("spdytest: reading frame: %v", err)
+	}
+	return frame
+}
+
+func (p *Peer) next() (spdy.Frame, error) {
+	timer := time.NewTimer(p.Timeout)
+	defer timer.Stop()
+	select {
+	case frame, ok := <-p.frames:
+		if !ok {
+			return nil, p.err
+		}
+		return frame, nil
+	case <-timer.C:
+		return nil, errTimeout
+	}
+}
+
+var errTimeout = errors.New("timed out waiting for a frame")
+
+// Expect reads the next frames from the code under test and fails the
+// test unless they equal want, in order. Frames are compared by their JSON
+// encodings, so lengths and other wire details do not matter.
+func (p *Peer) Expect(want ...spdy.Frame) {
+	p.tb.Helper()
+	for _, w := range want {
+		got, err := p.next()
+		if err != nil {
+			p.tb.Fatalf("spdytest: want %v, got error: %v", w, err)
+		}
+		if !Equal(w, got) {
+			p.tb.Fatalf("spdytest: want %v\ngot %v", w, got)
+		}
+	}
+}
+
+// ExpectFunc reads the next frame from the code under test and passes it
+// to check, failing the test if check returns an error. It suits frames
+// only partly known in advance.
+func (p *Peer) ExpectFunc(check func(spdy.Frame) error) spdy.Frame {
+	p.tb.Helper()
+	frame := p.Next()
+	if err := check(frame); err != nil {
+		p.tb.Fatalf("spdytest: %v: %v", frame, err)
+	}
+	return frame
+}
+
+// ExpectNone fails the test if the code under test sends a frame within d.
+func (p *Peer) ExpectNone(d time.Duration) {
+	p.tb.Helper()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case frame, ok := <-p.frames:
+		if ok {
+			p.tb.Fatalf("spdytest: want no frame, got %v", frame)
+		}
+	case <-timer.C:
+	}
+}
+
+// ExpectClosed fails the test unless the code under test closes the
+// connection, after any frames still unread, within the timeout.
+func (p *Peer) ExpectClosed() {
+	p.tb.Helper()
+	for {
+		_, err := p.next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.tb.Fatalf("spdytest: want the connection closed, got error: %v", err)
+		}
+	}
+}
+
+// Equal reports whether a and b are the same frame, comparing their JSON
+// encodings so that lengths and other wire details do not matter.
+func Equal(a, b spdy.Frame) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
@@ -0,0 +1,149 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdytest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	spdy "github.com/Jxck/go-spdy"
+)
+
+func newClient(t *testing.T) (*spdy.Session, *Peer) {
+	conn, peer := NewPair(t)
+	s, err := spdy.NewSession(conn, false)
+	if err != nil {
+		t.Fatal("NewSession:", err)
+	}
+	return s, peer
+}
+
+func TestClientStream(t *testing.T) {
+	s, peer := newClient(t)
+	h := http.Header{":method": {"GET"}, ":path": {"/"}}
+	st, err := s.OpenStream(h, true)
+	if err != nil {
+		t.Fatal("OpenStream:", err)
+	}
+	peer.Expect(&spdy.SynStreamFrame{
+		CFHeader: spdy.ControlFrameHeader{Flags: spdy.ControlFlagFin},
+		StreamId: 1,
+		Headers:  h,
+	})
+	peer.Send(
+		&spdy.SynReplyFrame{StreamId: 1, Headers: http.Header{":status": {"200 OK"}}},
+		&spdy.DataFrame{StreamId: 1, Data: []byte("hello")},
+		&spdy.DataFrame{StreamId: 1, Flags: spdy.DataFlagFin},
+	)
+	reply, err := st.Reply()
+	if err != nil {
+		t.Fatal("Reply:", err)
+	}
+	if status := reply.Get(":status"); status != "200 OK" {
+		t.Errorf(":status = %q; want %q", status, "200 OK")
+	}
+	body, err := ioutil.ReadAll(st)
+	if err != nil || string(body) != "hello" {
+		t.Errorf("read %q, %v; want %q", body, err, "hello")
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	_, peer := newClient(t)
+	// Pings with even ids come from the server and are echoed.
+	peer.Send(&spdy.PingFrame{Id: 2})
+	peer.Expect(&spdy.PingFrame{Id: 2})
+	// Odd ids are the client's own, so an unsolicited one is dropped.
+	peer.Send(&spdy.PingFrame{Id: 3})
+	peer.ExpectNone(50 * time.Millisecond)
+}
+
+func TestClientRejectsDataOnUnknownStream(t *testing.T) {
+	_, peer := newClient(t)
+	peer.Send(&spdy.DataFrame{StreamId: 5, Data: []byte("x")})
+	peer.Expect(&spdy.RstStreamFrame{StreamId: 5, Status: spdy.InvalidStream})
+}
+
+func TestClientClose(t *testing.T) {
+	s, peer := newClient(t)
+	peer.Send(&spdy.SynStreamFrame{StreamId: 2, Headers: http.Header{":path": {"/push"}}})
+	if _, err := s.Accept(); err != nil {
+		t.Fatal("Accept:", err)
+	}
+	go s.Close()
+	peer.Expect(&spdy.GoAwayFrame{LastGoodStreamId: 2, Status: spdy.GoAwayOK})
+	peer.ExpectClosed()
+}
+
+func TestServerRequest(t *testing.T) {
+	conn, peer := NewPair(t)
+	srv := &spdy.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	})}
+	go srv.ServeConn(conn)
+	peer.Send(&spdy.SynStreamFrame{
+		CFHeader: spdy.ControlFrameHeader{Flags: spdy.ControlFlagFin},
+		StreamId: 1,
+		Headers: http.Header{
+			":method":  {"GET"},
+			":path":    {"/x"},
+			":version": {"HTTP/1.1"},
+			":host":    {"example.com"},
+			":scheme":  {"https"},
+		},
+	})
+	peer.ExpectFunc(func(frame spdy.Frame) error {
+		reply, ok := frame.(*spdy.SynReplyFrame)
+		if !ok || reply.StreamId != 1 || reply.Headers.Get(":status") != "200 OK" {
+			return fmt.Errorf("want a 200 SYN_REPLY on stream 1")
+		}
+		return nil
+	})
+	peer.Expect(
+		&spdy.DataFrame{StreamId: 1, Data: []byte("GET /x")},
+		&spdy.DataFrame{StreamId: 1, Flags: spdy.DataFlagFin},
+	)
+}
+
+// fakeTB records failures instead of ending the test.
+type fakeTB struct {
+	testing.TB
+	failed string
+}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Fatalf(format string, args ...interface{}) {
+	tb.failed = fmt.Sprintf(format, args...)
+	panic(tb)
+}
+
+func TestExpectFailures(t *testing.T) {
+	fail := func(f func(*Peer)) (msg string) {
+		c, pc := net.Pipe()
+		defer c.Close()
+		tb := &fakeTB{TB: t}
+		p := NewPeer(tb, pc)
+		p.Timeout = 20 * time.Millisecond
+		defer func() {
+			if r := recover(); r != nil && r != tb {
+				panic(r)
+			}
+			msg = tb.failed
+		}()
+		f(p)
+		return
+	}
+	if msg := fail(func(p *Peer) { p.Expect(&spdy.PingFrame{Id: 1}) }); msg == "" {
+		t.Error("Expect with nothing sent did not time out")
+	}
+	if msg := fail(func(p *Peer) { p.Next() }); msg == "" {
+		t.Error("Next with nothing sent did not time out")
+	}
+}
@@ -0,0 +1,494 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errStreamClosed = errors.New("write on closed stream")
+
+var _ net.Conn = (*Stream)(nil)
+
+// StreamResetError reports that a stream ended with RST_STREAM. Remote is
+// set if the peer sent the frame.
+type StreamResetError struct {
+	StreamId StreamId
+	Status   RstStreamStatus
+	Remote   bool
+}
+
+func (e *StreamResetError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("stream %d reset by peer (%v)", e.StreamId, e.Status)
+	}
+	return fmt.Sprintf("stream %d reset (%v)", e.StreamId, e.Status)
+}
+
+// Stream is a single bidirectional stream within a Session. Read returns the
+// payload of the peer's DATA frames and Write sends DATA frames, subject to
+// the stream's flow control window. A Stream is a net.Conn: Close sends FIN
+// on the local side only, while CloseWithError resets the whole stream.
+type Stream struct {
+	session *Session
+	id      StreamId
+	local   bool // opened by this end of the session
+
+	mu         sync.Mutex    // guards the fields below
+	changed    chan struct{} // closed and replaced on every state change
+	failed     chan struct{} // closed when err is set
+	header     http.Header   // headers that opened the stream
+	trailer    http.Header   // headers of later HEADERS frames
+	replied    bool          // whether the peer's headers have arrived
+	continued  bool          // whether an interim 100 Continue has arrived
+	buf        bytes.Buffer  // received data not yet read
+	recvFin    bool
+	sendFin    bool
+	sendWindow int32
+	recvWindow int32
+	unacked    int32 // bytes read but not yet returned in WINDOW_UPDATE
+	err        error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(s *Session, id StreamId, sendWindow int32) *Stream {
+	return &Stream{
+		session:    s,
+		id:         id,
+		changed:    make(chan struct{}),
+		failed:     make(chan struct{}),
+		sendWindow: sendWindow,
+		recvWindow: defaultInitialWindowSize,
+	}
+}
+
+// Id returns the stream's id.
+func (st *Stream) Id() StreamId {
+	return st.id
+}
+
+// Header returns the headers the peer opened its side of the stream with:
+// those of the SYN_STREAM for a stream the peer opened, or of the SYN_REPLY
+// for one opened locally. Headers sent later, in HEADERS frames, are
+// returned by Trailer.
+func (st *Stream) Header() http.Header {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.header
+}
+
+// Trailer returns a copy of the headers received in HEADERS frames so far.
+// Once Read has returned io.EOF it holds them all.
+func (st *Stream) Trailer() http.Header {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	trailer := make(http.Header, len(st.trailer))
+	for name, values := range st.trailer {
+		trailer[name] = values
+	}
+	return trailer
+}
+
+// Reply waits for the peer's SYN_REPLY and returns its headers.
+func (st *Stream) Reply() (http.Header, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for !st.replied && st.err == nil {
+		st.waitLocked(time.Time{})
+	}
+	if !st.replied {
+		return nil, st.err
+	}
+	return st.header, nil
+}
+
+// WriteReply sends a SYN_REPLY frame carrying h. If fin is set the local
+// side of the stream is closed too.
+func (st *Stream) WriteReply(h http.Header, fin bool) error {
+	frame := &SynReplyFrame{StreamId: st.id, Headers: h}
+	if fin {
+		frame.CFHeader.Flags = ControlFlagFin
+		if err := st.closeSend(); err != nil {
+			return err
+		}
+	}
+	return st.session.writeFrame(frame)
+}
+
+// awaitContinue waits up to timeout for the peer to answer a request sent
+// with Expect: 100-continue. It reports whether to send the body: true once
+// 100 Continue arrives or the timeout passes, false if the reply comes
+// first.
+func (st *Stream) awaitContinue(timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for !st.continued && !st.replied && st.err == nil {
+		if !st.waitLocked(deadline) {
+			return true, nil
+		}
+	}
+	if st.err != nil {
+		return false, st.err
+	}
+	return st.continued, nil
+}
+
+// WriteHeaders sends a HEADERS frame carrying h, such as trailers after the
+// last of the data. If fin is set the local side of the stream is closed
+// too.
+func (st *Stream) WriteHeaders(h http.Header, fin bool) error {
+	frame := &HeadersFrame{StreamId: st.id, Headers: h}
+	if fin {
+		frame.CFHeader.Flags = ControlFlagFin
+		if err := st.closeSend(); err != nil {
+			return err
+		}
+	}
+	return st.session.writeFrame(frame)
+}
+
+// Read reads data the peer sent on the stream. It returns io.EOF once the
+// peer has closed its side and all data has been read. Data that arrived
+// before the stream ended is still returned, and so is io.EOF if the peer
+// closed its side before resetting the stream, as a server does when it
+// answers without reading the whole request; only a local CloseWithError
+// fails Read straight away.
+func (st *Stream) Read(p []byte) (n int, err error) {
+	st.mu.Lock()
+	if expired(st.readDeadline) {
+		st.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	for st.buf.Len() == 0 && !st.recvFin && st.err == nil {
+		if !st.waitLocked(st.readDeadline) {
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	if re, ok := st.err.(*StreamResetError); ok && !re.Remote {
+		st.mu.Unlock()
+		return 0, st.err
+	}
+	if st.buf.Len() == 0 {
+		err := st.err
+		if st.recvFin {
+			err = io.EOF
+		}
+		st.mu.Unlock()
+		return 0, err
+	}
+	n, _ = st.buf.Read(p)
+	var update int32
+	st.unacked += int32(n)
+	if !st.recvFin && st.err == nil && st.unacked >= defaultInitialWindowSize/2 {
+		update = st.unacked
+		st.recvWindow += update
+		st.unacked = 0
+	}
+	st.mu.Unlock()
+	if update > 0 {
+		st.session.queueFrame(&WindowUpdateFrame{StreamId: st.id, DeltaWindowSize: uint32(update)}, false)
+	}
+	return n, nil
+}
+
+// Write sends p in DATA frames, blocking while the peer's flow control
+// window is exhausted. The write deadline bounds that wait; a frame that has
+// been handed to the session is always written in full.
+func (st *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		st.mu.Lock()
+		if expired(st.writeDeadline) {
+			st.mu.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
+		if st.sendWindow <= 0 && st.err == nil && !st.sendFin {
+			start := time.Now()
+			for st.sendWindow <= 0 && st.err == nil && !st.sendFin {
+				if !st.waitLocked(st.writeDeadline) {
+					st.mu.Unlock()
+					st.session.metrics.FlowControlStall(time.Since(start))
+					return n, os.ErrDeadlineExceeded
+				}
+			}
+			st.session.metrics.FlowControlStall(time.Since(start))
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return n, st.err
+		}
+		if st.sendFin {
+			st.mu.Unlock()
+			return n, errStreamClosed
+		}
+		chunk := len(p)
+		if chunk > int(st.sendWindow) {
+			chunk = int(st.sendWindow)
+		}
+		if chunk > maxDataChunk {
+			chunk = maxDataChunk
+		}
+		st.sendWindow -= int32(chunk)
+		st.mu.Unlock()
+
+		if err = st.session.writeFrame(&DataFrame{StreamId: st.id, Data: p[:chunk]}); err != nil {
+			return n, err
+		}
+		n += chunk
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+// Close closes the local side of the stream by sending an empty DATA frame
+// with the FIN flag. The peer may carry on sending until it does the same.
+func (st *Stream) Close() error {
+	if err := st.closeSend(); err != nil {
+		if err == errStreamClosed {
+			return nil
+		}
+		return err
+	}
+	return st.session.writeFrame(&DataFrame{StreamId: st.id, Flags: DataFlagFin})
+}
+
+// closeSend marks the local side of the stream closed.
+func (st *Stream) closeSend() error {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return st.err
+	}
+	if st.sendFin {
+		st.mu.Unlock()
+		return errStreamClosed
+	}
+	st.sendFin = true
+	done := st.recvFin
+	st.notifyLocked()
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return nil
+}
+
+// CloseWithError aborts both sides of the stream by sending RST_STREAM with
+// status. Blocked and later Read and Write calls fail with a
+// *StreamResetError. It does nothing if the stream has already ended.
+func (st *Stream) CloseWithError(status RstStreamStatus) error {
+	if status == 0 {
+		return &Error{Err: InvalidControlFrame, StreamId: st.id}
+	}
+	st.mu.Lock()
+	ended := st.err != nil || st.sendFin && st.recvFin
+	st.mu.Unlock()
+	if !ended {
+		st.session.resetStream(st.id, status)
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the session's connection.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the session's connection.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets both the read and the write deadline.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.notifyLocked()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read calls waiting for data.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.readDeadline = t
+	st.notifyLocked()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls waiting for the flow
+// control window to open.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.writeDeadline = t
+	st.notifyLocked()
+	return nil
+}
+
+// expired reports whether deadline is set and has passed.
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// waitLocked releases st.mu until the stream's state next changes. It
+// reports false if deadline, unless zero, passes first.
+func (st *Stream) waitLocked(deadline time.Time) bool {
+	ch := st.changed
+	if deadline.IsZero() {
+		st.mu.Unlock()
+		<-ch
+		st.mu.Lock()
+		return true
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	t := time.NewTimer(d)
+	st.mu.Unlock()
+	select {
+	case <-ch:
+	case <-t.C:
+	}
+	t.Stop()
+	st.mu.Lock()
+	return true
+}
+
+func (st *Stream) notifyLocked() {
+	close(st.changed)
+	st.changed = make(chan struct{})
+}
+
+// fail ends the stream with err, waking anything blocked on it.
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil {
+		return
+	}
+	st.err = err
+	close(st.failed)
+	st.notifyLocked()
+}
+
+// receiveReply records the peer's SYN_REPLY. It reports false if the stream
+// already had one.
+func (st *Stream) receiveReply(h http.Header, fin bool) bool {
+	st.mu.Lock()
+	if st.replied {
+		st.mu.Unlock()
+		return false
+	}
+	st.replied = true
+	st.header = h
+	done := st.receiveFinLocked(fin)
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return true
+}
+
+// receiveHeaders adds the headers of a HEADERS frame to the stream's
+// trailer. Before the SYN_REPLY of a stream opened locally, a HEADERS frame
+// with a 1xx :status is instead an interim response. It returns the status
+// to reset the stream with, or 0 if all is well.
+func (st *Stream) receiveHeaders(h http.Header, fin bool) RstStreamStatus {
+	st.mu.Lock()
+	if !st.replied {
+		defer st.mu.Unlock()
+		status := h.Get(":status")
+		if !st.local || fin || len(status) < 3 || status[0] != '1' {
+			return ProtocolError
+		}
+		if strings.HasPrefix(status, "100") {
+			st.continued = true
+			st.notifyLocked()
+		}
+		return 0
+	}
+	if st.recvFin {
+		st.mu.Unlock()
+		return StreamAlreadyClosed
+	}
+	if st.trailer == nil {
+		st.trailer = make(http.Header)
+	}
+	for name, values := range h {
+		st.trailer[name] = append(st.trailer[name], values...)
+	}
+	done := st.receiveFinLocked(fin)
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return 0
+}
+
+// receiveData buffers the payload of a DATA frame. It returns the status to
+// reset the stream with, or 0 if all is well.
+func (st *Stream) receiveData(data []byte, fin bool) RstStreamStatus {
+	st.mu.Lock()
+	if !st.replied {
+		st.mu.Unlock()
+		return ProtocolError
+	}
+	if st.recvFin {
+		st.mu.Unlock()
+		return StreamAlreadyClosed
+	}
+	if len(data) > int(st.recvWindow) {
+		st.mu.Unlock()
+		return FlowControlError
+	}
+	st.recvWindow -= int32(len(data))
+	st.buf.Write(data)
+	done := st.receiveFinLocked(fin)
+	st.mu.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return 0
+}
+
+// receiveFinLocked records whether the peer closed its side and wakes any
+// readers. It reports whether both sides are now closed.
+func (st *Stream) receiveFinLocked(fin bool) bool {
+	if fin {
+		st.recvFin = true
+	}
+	st.notifyLocked()
+	return st.recvFin && st.sendFin
+}
+
+// growSendWindow adjusts the send window by delta. It reports false if the
+// window would overflow.
+func (st *Stream) growSendWindow(delta int32) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	w := int64(st.sendWindow) + int64(delta)
+	if w > 1<<31-1 {
+		return false
+	}
+	st.sendWindow = int32(w)
+	st.notifyLocked()
+	return true
+}
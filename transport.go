@@ -0,0 +1,452 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that sends each request on a stream of
+// a SPDY session, keeping one session per host and port. Cancelling a
+// request's context resets its stream with CANCEL.
+type Transport struct {
+	// Dial connects to addr, given as host:port. If nil, https requests
+	// are made over TLS negotiating spdy/3 with TLSClientConfig, and http
+	// requests over plain TCP.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Cleartext chooses, for each host:port, how to start sessions for
+	// http requests. If nil, they all use PriorKnowledge.
+	Cleartext func(addr string) CleartextMode
+
+	// TLSClientConfig is the TLS configuration of the default dialer.
+	TLSClientConfig *tls.Config
+
+	// Metrics receives the sessions' metrics, DefaultMetrics if nil.
+	Metrics Metrics
+
+	// ExpectContinueTimeout, if non-zero, is how long to wait for the
+	// server to accept the body of a request sent with Expect:
+	// 100-continue before sending it anyway. If the server replies first,
+	// the body is not sent at all. Zero sends the body straight away.
+	ExpectContinueTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session  // by scheme and host:port
+	dials    map[string]*dialCall // sessions being started, by the same key
+}
+
+// dialCall is a session being started. Requests for the same host wait for
+// it rather than dialing again.
+type dialCall struct {
+	done chan struct{} // closed once s and err are set
+	s    *Session
+	err  error
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil || req.URL.Host == "" {
+		return nil, errors.New("spdy: request has no host")
+	}
+	if req.URL.Scheme != "https" && req.URL.Scheme != "http" {
+		return nil, fmt.Errorf("spdy: unsupported scheme %q", req.URL.Scheme)
+	}
+	ctx := req.Context()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	scheme, addr := req.URL.Scheme, canonicalAddr(req)
+	h := requestHeaderBlock(req)
+	fin := req.Body == nil || req.Body == http.NoBody
+
+	st, err := t.openStream(ctx, scheme, addr, h, fin)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// Reset the stream if the request is cancelled before the response
+	// body has been read or closed.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			st.CloseWithError(Cancel)
+		case <-st.failed:
+		case <-done:
+		}
+	}()
+	if !fin {
+		var wait time.Duration
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			wait = t.ExpectContinueTimeout
+		}
+		go sendRequestBody(st, req.Body, req.Trailer, wait)
+	}
+
+	reply, err := st.Reply()
+	if err != nil {
+		close(done)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp, err := newClientResponse(req, reply)
+	if err != nil {
+		st.CloseWithError(ProtocolError)
+		close(done)
+		return nil, err
+	}
+	resp.Body = &responseBody{stream: st, ctx: ctx, done: done, trailer: &resp.Trailer}
+	return resp, nil
+}
+
+// declaredTrailer returns a header with a nil entry for each name h
+// declares in its Trailer header, or nil if it declares none.
+func declaredTrailer(h http.Header) http.Header {
+	var trailer http.Header
+	for _, line := range h["Trailer"] {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			trailer[name] = nil
+		}
+	}
+	return trailer
+}
+
+// copyTrailer adds the trailers received on st to *dst, which is made if
+// need be.
+func copyTrailer(dst *http.Header, st *Stream) {
+	trailer := st.Trailer()
+	if len(trailer) == 0 {
+		return
+	}
+	if *dst == nil {
+		*dst = make(http.Header, len(trailer))
+	}
+	for name, values := range trailer {
+		(*dst)[name] = values
+	}
+}
+
+// openStream opens a stream carrying h on the session to addr. If the
+// session turns out to have ended, it retries once on a new session.
+func (t *Transport) openStream(ctx context.Context, scheme, addr string, h http.Header, fin bool) (*Stream, error) {
+	for retry := true; ; retry = false {
+		s, err := t.session(ctx, scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+		st, err := s.OpenStream(h, fin)
+		if err == nil {
+			return st, nil
+		}
+		t.removeSession(scheme+"://"+addr, s)
+		if !retry || (err != ErrGoAway && err != ErrSessionClosed) {
+			return nil, err
+		}
+	}
+}
+
+// CloseIdleConnections closes the transport's sessions that have no
+// streams open. Sessions with requests still in flight are left alone.
+func (t *Transport) CloseIdleConnections() {
+	var idle []*Session
+	t.mu.Lock()
+	for key, s := range t.sessions {
+		if s.closed() || s.idle() {
+			delete(t.sessions, key)
+			idle = append(idle, s)
+		}
+	}
+	t.mu.Unlock()
+	for _, s := range idle {
+		s.Close()
+	}
+}
+
+// session returns the session to addr, starting one if there is none that
+// can still open streams. The lock is not held while dialing, so that a slow
+// host holds up only the requests to it. A caller waiting on another's dial
+// gives up when ctx is done; the dial itself carries on for the others.
+func (t *Transport) session(ctx context.Context, scheme, addr string) (*Session, error) {
+	key := scheme + "://" + addr
+	t.mu.Lock()
+	if s := t.sessions[key]; s != nil && !s.closed() {
+		t.mu.Unlock()
+		return s, nil
+	}
+	if call := t.dials[key]; call != nil {
+		t.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.s, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &dialCall{done: make(chan struct{})}
+	if t.dials == nil {
+		t.dials = make(map[string]*dialCall)
+	}
+	t.dials[key] = call
+	t.mu.Unlock()
+
+	call.s, call.err = t.startSession(scheme, addr)
+
+	t.mu.Lock()
+	delete(t.dials, key)
+	if call.err == nil {
+		if t.sessions == nil {
+			t.sessions = make(map[string]*Session)
+		}
+		t.sessions[key] = call.s
+	}
+	t.mu.Unlock()
+	close(call.done)
+	return call.s, call.err
+}
+
+// startSession dials addr and starts a session on the connection.
+func (t *Transport) startSession(scheme, addr string) (*Session, error) {
+	conn, err := t.dial(scheme, addr)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "http" && t.Cleartext != nil && t.Cleartext(addr) == Upgrade {
+		uc, err := upgradeConn(conn, addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = uc
+	}
+	m := t.Metrics
+	if m == nil {
+		m = DefaultMetrics
+	}
+	s, err := newSession(conn, false, m)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t *Transport) removeSession(key string, s *Session) {
+	t.mu.Lock()
+	if t.sessions[key] == s {
+		delete(t.sessions, key)
+	}
+	t.mu.Unlock()
+}
+
+func (t *Transport) dial(scheme, addr string) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial("tcp", addr)
+	}
+	if scheme == "http" {
+		return net.Dial("tcp", addr)
+	}
+	cfg := new(tls.Config)
+	if t.TLSClientConfig != nil {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	cfg.NextProtos = []string{"spdy/3"}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "spdy/3" {
+		conn.Close()
+		return nil, fmt.Errorf("spdy: %s negotiated %q, not spdy/3", addr, p)
+	}
+	return conn, nil
+}
+
+// canonicalAddr returns the host:port of req's URL, adding the scheme's
+// default port if there is none.
+func canonicalAddr(req *http.Request) string {
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if req.URL.Scheme == "http" {
+		return net.JoinHostPort(host, "80")
+	}
+	return net.JoinHostPort(host, "443")
+}
+
+// requestHeaderBlock returns the SYN_STREAM headers carrying req.
+func requestHeaderBlock(req *http.Request) http.Header {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	method := req.Method
+	if method == "" {
+		method = "GET"
+	}
+	h := http.Header{
+		":method":  {method},
+		":path":    {req.URL.RequestURI()},
+		":version": {"HTTP/1.1"},
+		":host":    {host},
+		":scheme":  {req.URL.Scheme},
+	}
+	for name, values := range req.Header {
+		if !invalidReqHeaders[http.CanonicalHeaderKey(name)] {
+			h[name] = values
+		}
+	}
+	if len(req.Trailer) > 0 && h.Get("Trailer") == "" {
+		names := make([]string, 0, len(req.Trailer))
+		for name := range req.Trailer {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h.Set("Trailer", strings.Join(names, ", "))
+	}
+	if req.ContentLength > 0 && h.Get("Content-Length") == "" {
+		h.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+	return h
+}
+
+// sendRequestBody copies body to st and closes the local side of the
+// stream, with a HEADERS frame carrying trailer if it has any values, or
+// resets it if body fails. As with net/http, trailer may be filled in while
+// the body is read. If wait is non-zero, the body is held back for up to
+// that long for 100 Continue, and dropped if the reply arrives first.
+func sendRequestBody(st *Stream, body io.ReadCloser, trailer http.Header, wait time.Duration) {
+	defer body.Close()
+	if wait > 0 {
+		send, err := st.awaitContinue(wait)
+		if err != nil {
+			return
+		}
+		if !send {
+			st.Close()
+			return
+		}
+	}
+	if _, err := io.Copy(st, body); err != nil {
+		if _, ok := err.(*StreamResetError); !ok {
+			st.CloseWithError(Cancel)
+		}
+		return
+	}
+	h := make(http.Header)
+	for name, values := range trailer {
+		if len(values) > 0 && !invalidReqHeaders[http.CanonicalHeaderKey(name)] {
+			h[name] = values
+		}
+	}
+	if len(h) > 0 {
+		st.WriteHeaders(h, true)
+	} else {
+		st.Close()
+	}
+}
+
+// newClientResponse builds the response to req from the SYN_REPLY headers.
+func newClientResponse(req *http.Request, h http.Header) (*http.Response, error) {
+	status, version := h.Get(":status"), h.Get(":version")
+	if status == "" || version == "" {
+		return nil, errors.New("spdy: reply lacks :status or :version")
+	}
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil || code < 100 || code > 999 {
+		return nil, fmt.Errorf("spdy: malformed :status %q", status)
+	}
+	major, minor, ok := http.ParseHTTPVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("spdy: malformed :version %q", version)
+	}
+	resp := &http.Response{
+		Status:        status,
+		StatusCode:    code,
+		Proto:         version,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        make(http.Header),
+		Trailer:       declaredTrailer(h),
+		ContentLength: -1,
+		Request:       req,
+	}
+	for name, values := range h {
+		if !strings.HasPrefix(name, ":") {
+			resp.Header[name] = values
+		}
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			resp.ContentLength = n
+		}
+	}
+	return resp, nil
+}
+
+// responseBody is the body of a client response. Closing it before the end
+// resets the stream.
+type responseBody struct {
+	stream    *Stream
+	ctx       context.Context
+	done      chan struct{} // closed once the body is finished with
+	closeOnce sync.Once
+	eof       bool
+	trailer   *http.Header // the response's Trailer, filled in at EOF
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.stream.Read(p)
+	if err == io.EOF {
+		b.eof = true
+		copyTrailer(b.trailer, b.stream)
+		// The response is complete, so the server has no use for the
+		// rest of a request body still being sent.
+		b.stream.CloseWithError(Cancel)
+		b.finish()
+	} else if err != nil && b.ctx.Err() != nil {
+		err = b.ctx.Err()
+	}
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	if !b.eof {
+		b.stream.CloseWithError(Cancel)
+	}
+	b.finish()
+	return nil
+}
+
+func (b *responseBody) finish() {
+	b.closeOnce.Do(func() { close(b.done) })
+}
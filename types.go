@@ -9,6 +9,7 @@ package spdy
 import (
 	"bytes"
 	"compress/zlib"
+	"fmt"
 	"io"
 	"net/http"
 )
@@ -52,6 +53,10 @@ const MaxDataLength = 1<<24 - 1
 // headerValueSepator separates multiple header values.
 const headerValueSeparator = "\x00"
 
+// maxHeaderBlockSize bounds the names and values of a header block once
+// decompressed, so that a peer cannot make the reader allocate without end.
+const maxHeaderBlockSize = 1 << 20
+
 // Frame is a single SPDY frame in its unpacked in-memory representation. Use
 // Framer to read and write it.
 type Frame interface {
@@ -68,6 +73,81 @@ type ControlFrameHeader struct {
 	length    uint32 // length of data field
 }
 
+// NewControlFrameHeader returns a control frame header with the given
+// fields, as if it had been read from the wire. WriteFrame ignores all but
+// the flags, setting the rest from the frame it writes.
+func NewControlFrameHeader(version uint16, frameType ControlFrameType, flags ControlFlags, length uint32) ControlFrameHeader {
+	return ControlFrameHeader{version, frameType, flags, length}
+}
+
+// Version returns the SPDY version the frame was read or written with.
+func (h ControlFrameHeader) Version() uint16 {
+	return h.version
+}
+
+// Type returns the frame's type.
+func (h ControlFrameHeader) Type() ControlFrameType {
+	return h.frameType
+}
+
+// Length returns the length of the frame's payload, the 8-byte header
+// excluded, as it was read or written.
+func (h ControlFrameHeader) Length() uint32 {
+	return h.length
+}
+
+// WireSize returns the number of bytes frame took on the wire, its 8-byte
+// header included, when ReadFrame returned it or WriteFrame last wrote it.
+func WireSize(frame Frame) int {
+	const headerSize = 8
+	var h ControlFrameHeader
+	switch frame := frame.(type) {
+	case *DataFrame:
+		return headerSize + len(frame.Data)
+	case *SynStreamFrame:
+		h = frame.CFHeader
+	case *SynReplyFrame:
+		h = frame.CFHeader
+	case *RstStreamFrame:
+		h = frame.CFHeader
+	case *SettingsFrame:
+		h = frame.CFHeader
+	case *PingFrame:
+		h = frame.CFHeader
+	case *GoAwayFrame:
+		h = frame.CFHeader
+	case *HeadersFrame:
+		h = frame.CFHeader
+	case *WindowUpdateFrame:
+		h = frame.CFHeader
+	}
+	return headerSize + int(h.length)
+}
+
+// controlFrameType returns the type of a control frame, or 0 for a DATA
+// frame.
+func controlFrameType(frame Frame) ControlFrameType {
+	switch frame.(type) {
+	case *SynStreamFrame:
+		return TypeSynStream
+	case *SynReplyFrame:
+		return TypeSynReply
+	case *RstStreamFrame:
+		return TypeRstStream
+	case *SettingsFrame:
+		return TypeSettings
+	case *PingFrame:
+		return TypePing
+	case *GoAwayFrame:
+		return TypeGoAway
+	case *HeadersFrame:
+		return TypeHeaders
+	case *WindowUpdateFrame:
+		return TypeWindowUpdate
+	}
+	return 0
+}
+
 type controlFrame interface {
 	Frame
 	read(h ControlFrameHeader, f *Framer) error
@@ -203,6 +283,20 @@ type DataFrame struct {
 	Data     []byte // payload data of this frame
 }
 
+// FrameHeader is what ReadFrameHeader reads of a frame: its fixed 8-byte
+// header and, for frames addressed to a stream, the stream id that starts
+// the payload of control frames.
+type FrameHeader struct {
+	Control  bool
+	Version  uint16           // control frames only
+	Type     ControlFrameType // control frames only
+	Flags    uint8            // ControlFlags or DataFlags
+	Length   uint32           // length of the payload
+	StreamId StreamId         // 0 for SETTINGS, PING and GOAWAY frames
+
+	read int // bytes of the payload ReadFrameHeader consumed
+}
+
 // A SPDY specific error.
 type ErrorCode string
 
@@ -215,19 +309,126 @@ const (
 	InvalidDataFrame                     = "invalid data frame"
 	InvalidHeaderPresent                 = "frame contained invalid header"
 	ZeroStreamId                         = "stream id zero is disallowed"
+	InvalidHeaderName                    = "header name was empty or contained NUL"
+	InvalidHeaderValue                   = "header value could not be encoded"
+	CorruptHeaderBlock                   = "header block failed to decompress"
+	ReservedBitSet                       = "reserved bit was set"
+	InvalidFlags                         = "flags not valid for frame type"
+	InvalidFrameLength                   = "frame length not valid for frame type"
+	HeaderBlockTooLarge                  = "header block was too large"
+	StreamNotOpen                        = "frame for a stream that is not open"
+	UnsupportedFrameVersion              = "control frame version is not supported"
+	WindowExceeded                       = "flow control window was exceeded"
+	ReadFailed                           = "frame could not be read"
 )
 
+// ErrorScope says how much of a session an Error spoils.
+type ErrorScope int
+
+const (
+	// ScopeSession errors leave the framer out of step with the peer, or
+	// the header compression context in doubt, so the session has to end
+	// with GOAWAY.
+	ScopeSession ErrorScope = iota
+
+	// ScopeStream errors concern only the stream StreamId. Resetting it
+	// is enough; the session carries on.
+	ScopeStream
+)
+
+func (s ErrorScope) String() string {
+	switch s {
+	case ScopeSession:
+		return "session"
+	case ScopeStream:
+		return "stream"
+	}
+	return fmt.Sprintf("ErrorScope(%d)", int(s))
+}
+
 // Error contains both the type of error and additional values. StreamId is 0
-// if Error is not associated with a stream.
+// if Error is not associated with a stream. FrameType is 0 for DATA frames
+// and for errors not found in a frame.
 type Error struct {
-	Err      ErrorCode
-	StreamId StreamId
+	Err       ErrorCode
+	StreamId  StreamId
+	FrameType ControlFrameType
+	Scope     ErrorScope
+	Cause     error // the underlying error, if any
 }
 
 func (e *Error) Error() string {
+	if e.Cause != nil {
+		return string(e.Err) + ": " + e.Cause.Error()
+	}
 	return string(e.Err)
 }
 
+// Unwrap returns the error that caused e, such as a zlib or I/O error.
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is an *Error with the same code, so that
+// errors.Is(err, ErrZeroStreamId) holds whatever the stream, frame type and
+// cause of err.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Err == e.Err
+}
+
+// RstStreamStatus returns the status to reset StreamId with after a stream
+// error. Conditions without a status of their own are protocol errors.
+func (e *Error) RstStreamStatus() RstStreamStatus {
+	switch e.Err {
+	case HeaderBlockTooLarge:
+		return FrameTooLarge
+	case StreamNotOpen:
+		return InvalidStream
+	case UnsupportedFrameVersion:
+		return UnsupportedVersion
+	case WindowExceeded:
+		return FlowControlError
+	case CorruptHeaderBlock, ReadFailed:
+		return InternalError
+	}
+	return ProtocolError
+}
+
+// GoAwayStatus returns the status of the GOAWAY that ends a session after a
+// session error. Failures to decompress or read are internal errors; the
+// rest are protocol errors.
+func (e *Error) GoAwayStatus() GoAwayStatus {
+	switch e.Err {
+	case CorruptHeaderBlock, ReadFailed:
+		return GoAwayInternalError
+	}
+	return GoAwayProtocolError
+}
+
+// Sentinel errors for each ErrorCode, for use with errors.Is.
+var (
+	ErrUnlowercasedHeaderName     = &Error{Err: UnlowercasedHeaderName}
+	ErrDuplicateHeaders           = &Error{Err: DuplicateHeaders}
+	ErrWrongCompressedPayloadSize = &Error{Err: WrongCompressedPayloadSize}
+	ErrUnknownFrameType           = &Error{Err: UnknownFrameType}
+	ErrInvalidControlFrame        = &Error{Err: InvalidControlFrame}
+	ErrInvalidDataFrame           = &Error{Err: InvalidDataFrame}
+	ErrInvalidHeaderPresent       = &Error{Err: InvalidHeaderPresent}
+	ErrZeroStreamId               = &Error{Err: ZeroStreamId}
+	ErrInvalidHeaderName          = &Error{Err: InvalidHeaderName}
+	ErrInvalidHeaderValue         = &Error{Err: InvalidHeaderValue}
+	ErrCorruptHeaderBlock         = &Error{Err: CorruptHeaderBlock}
+	ErrReservedBitSet             = &Error{Err: ReservedBitSet}
+	ErrInvalidFlags               = &Error{Err: InvalidFlags}
+	ErrInvalidFrameLength         = &Error{Err: InvalidFrameLength}
+	ErrHeaderBlockTooLarge        = &Error{Err: HeaderBlockTooLarge}
+	ErrStreamNotOpen              = &Error{Err: StreamNotOpen}
+	ErrUnsupportedFrameVersion    = &Error{Err: UnsupportedFrameVersion}
+	ErrWindowExceeded             = &Error{Err: WindowExceeded}
+	ErrReadFailed                 = &Error{Err: ReadFailed}
+)
+
 var invalidReqHeaders = map[string]bool{
 	"Connection":        true,
 	"Host":              true,
@@ -253,6 +454,23 @@ type Framer struct {
 	r                         io.Reader
 	headerReader              io.LimitedReader
 	headerDecompressor        io.ReadCloser
+	hooks                     *FrameHooks
+	parseMode                 ParseMode
+
+	// Scratch space for the fixed-size fields of frames, so that encoding
+	// and decoding them does not allocate.
+	rbuf [8]byte
+	wbuf [18]byte
+
+	// Stand-ins for w and r while AppendFrame, ParseFrame and
+	// ReadFrameBody run.
+	appendBuf appendWriter
+	parseBuf  bytes.Reader
+	bodyBuf   prefixReader
+
+	// frameReader limits reads to the payload of the control frame being
+	// read.
+	frameReader io.LimitedReader
 }
 
 // NewFramer allocates a new Framer for a given SPDY connection, repesented by
@@ -21,26 +21,22 @@ func (frame *SynReplyFrame) write(f *Framer) error {
 
 func (frame *RstStreamFrame) write(f *Framer) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	frame.CFHeader.version = Version
 	frame.CFHeader.frameType = TypeRstStream
 	frame.CFHeader.Flags = 0
 	frame.CFHeader.length = 8
-
-	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
-		return
-	}
 	if frame.Status == 0 {
-		return &Error{InvalidControlFrame, frame.StreamId}
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Status); err != nil {
-		return
+		return &Error{Err: InvalidControlFrame, StreamId: frame.StreamId}
 	}
+
+	// Serialize frame to Writer.
+	b := f.wbuf[:16]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(frame.StreamId))
+	binary.BigEndian.PutUint32(b[12:], uint32(frame.Status))
+	_, err = f.w.Write(b)
 	return
 }
 
@@ -50,18 +46,17 @@ func (frame *SettingsFrame) write(f *Framer) (err error) {
 	frame.CFHeader.length = uint32(len(frame.FlagIdValues)*8 + 4)
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, uint32(len(frame.FlagIdValues))); err != nil {
+	b := f.wbuf[:12]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(frame.FlagIdValues)))
+	if _, err = f.w.Write(b); err != nil {
 		return
 	}
+	b = f.wbuf[:8]
 	for _, flagIdValue := range frame.FlagIdValues {
-		flagId := uint32(flagIdValue.Flag)<<24 | uint32(flagIdValue.Id)
-		if err = binary.Write(f.w, binary.BigEndian, flagId); err != nil {
-			return
-		}
-		if err = binary.Write(f.w, binary.BigEndian, flagIdValue.Value); err != nil {
+		binary.BigEndian.PutUint32(b, uint32(flagIdValue.Flag)<<24|uint32(flagIdValue.Id))
+		binary.BigEndian.PutUint32(b[4:], flagIdValue.Value)
+		if _, err = f.w.Write(b); err != nil {
 			return
 		}
 	}
@@ -70,7 +65,7 @@ func (frame *SettingsFrame) write(f *Framer) (err error) {
 
 func (frame *PingFrame) write(f *Framer) (err error) {
 	if frame.Id == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	frame.CFHeader.version = Version
 	frame.CFHeader.frameType = TypePing
@@ -78,12 +73,10 @@ func (frame *PingFrame) write(f *Framer) (err error) {
 	frame.CFHeader.length = 4
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Id); err != nil {
-		return
-	}
+	b := f.wbuf[:12]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], frame.Id)
+	_, err = f.w.Write(b)
 	return
 }
 
@@ -94,16 +87,12 @@ func (frame *GoAwayFrame) write(f *Framer) (err error) {
 	frame.CFHeader.length = 8
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.LastGoodStreamId); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Status); err != nil {
-		return
-	}
-	return nil
+	b := f.wbuf[:16]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(frame.LastGoodStreamId))
+	binary.BigEndian.PutUint32(b[12:], uint32(frame.Status))
+	_, err = f.w.Write(b)
+	return
 }
 
 func (frame *HeadersFrame) write(f *Framer) error {
@@ -117,16 +106,12 @@ func (frame *WindowUpdateFrame) write(f *Framer) (err error) {
 	frame.CFHeader.length = 8
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.DeltaWindowSize); err != nil {
-		return
-	}
-	return nil
+	b := f.wbuf[:16]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(frame.StreamId))
+	binary.BigEndian.PutUint32(b[12:], frame.DeltaWindowSize)
+	_, err = f.w.Write(b)
+	return
 }
 
 func (frame *DataFrame) write(f *Framer) error {
@@ -135,44 +120,101 @@ func (frame *DataFrame) write(f *Framer) error {
 
 // WriteFrame writes a frame.
 func (f *Framer) WriteFrame(frame Frame) error {
-	return frame.write(f)
+	err := frame.write(f)
+	if e, ok := err.(*Error); ok && e.FrameType == 0 {
+		e.FrameType = controlFrameType(frame)
+	}
+	if f.hooks != nil {
+		f.hooks.frameWritten(frame, err)
+	}
+	return err
 }
 
-func writeControlFrameHeader(w io.Writer, h ControlFrameHeader) error {
-	if err := binary.Write(w, binary.BigEndian, 0x8000|h.version); err != nil {
-		return err
-	}
-	if err := binary.Write(w, binary.BigEndian, h.frameType); err != nil {
-		return err
+// AppendFrame appends the encoding of frame to dst and returns the extended
+// slice. Header blocks are compressed in the same context as WriteFrame's, so
+// frames may be written either way, in any mix, as long as they reach the
+// peer in the order they were encoded. On error dst is returned unchanged.
+func (f *Framer) AppendFrame(dst []byte, frame Frame) ([]byte, error) {
+	w := f.w
+	f.appendBuf = dst
+	f.w = &f.appendBuf
+	err := f.WriteFrame(frame)
+	f.w = w
+	b := f.appendBuf
+	f.appendBuf = nil
+	if err != nil {
+		return dst, err
+	}
+	return b, nil
+}
+
+// appendWriter is an io.Writer that appends to a slice.
+type appendWriter []byte
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	*w = append(*w, p...)
+	return len(p), nil
+}
+
+// putControlFrameHeader encodes h into the first 8 bytes of b.
+func putControlFrameHeader(b []byte, h ControlFrameHeader) {
+	binary.BigEndian.PutUint16(b, 0x8000|h.version)
+	binary.BigEndian.PutUint16(b[2:], uint16(h.frameType))
+	binary.BigEndian.PutUint32(b[4:], uint32(h.Flags)<<24|h.length)
+}
+
+// writeHeaderValueBlock serializes h as a name/value header block and returns
+// the exact number of bytes written to w. The whole block is validated before
+// anything is written, so an invalid header never reaches a shared
+// compression context.
+func writeHeaderValueBlock(w io.Writer, h http.Header, streamId StreamId) (n int, err error) {
+	// Map each lowercased name to its key in h.
+	names := make(map[string]string, len(h))
+	for name, values := range h {
+		lname := strings.ToLower(name)
+		if lname == "" || strings.Contains(lname, headerValueSeparator) {
+			return 0, &Error{Err: InvalidHeaderName, StreamId: streamId, Scope: ScopeStream}
+		}
+		if _, ok := names[lname]; ok {
+			return 0, &Error{Err: DuplicateHeaders, StreamId: streamId, Scope: ScopeStream}
+		}
+		// An empty value list has no encoding, and an empty value next to
+		// others would be read back as a stray separator.
+		if len(values) == 0 {
+			return 0, &Error{Err: InvalidHeaderValue, StreamId: streamId, Scope: ScopeStream}
+		}
+		for _, v := range values {
+			if strings.Contains(v, headerValueSeparator) || v == "" && len(values) > 1 {
+				return 0, &Error{Err: InvalidHeaderValue, StreamId: streamId, Scope: ScopeStream}
+			}
+		}
+		names[lname] = name
 	}
-	flagsAndLength := uint32(h.Flags)<<24 | h.length
-	if err := binary.Write(w, binary.BigEndian, flagsAndLength); err != nil {
+
+	var scratch [4]byte
+	writeUint32 := func(v uint32) error {
+		binary.BigEndian.PutUint32(scratch[:], v)
+		_, err := w.Write(scratch[:])
 		return err
 	}
-	return nil
-}
-
-func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
-	n = 0
-	if err = binary.Write(w, binary.BigEndian, uint32(len(h))); err != nil {
+	if err = writeUint32(uint32(len(names))); err != nil {
 		return
 	}
-	n += 2
-	for name, values := range h {
-		if err = binary.Write(w, binary.BigEndian, uint32(len(name))); err != nil {
+	n += 4
+	for lname, name := range names {
+		if err = writeUint32(uint32(len(lname))); err != nil {
 			return
 		}
-		n += 2
-		name = strings.ToLower(name)
-		if _, err = io.WriteString(w, name); err != nil {
+		n += 4
+		if _, err = io.WriteString(w, lname); err != nil {
 			return
 		}
-		n += len(name)
-		v := strings.Join(values, headerValueSeparator)
-		if err = binary.Write(w, binary.BigEndian, uint32(len(v))); err != nil {
+		n += len(lname)
+		v := strings.Join(h[name], headerValueSeparator)
+		if err = writeUint32(uint32(len(v))); err != nil {
 			return
 		}
-		n += 2
+		n += 4
 		if _, err = io.WriteString(w, v); err != nil {
 			return
 		}
@@ -183,19 +225,23 @@ func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
 
 func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	// Marshal the headers.
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	var n int
+	if n, err = writeHeaderValueBlock(writer, frame.Headers, frame.StreamId); err != nil {
 		return
 	}
 	if !f.headerCompressionDisabled {
 		f.headerCompressor.Flush()
 	}
+	if f.hooks != nil && f.hooks.OnHeadersCompressed != nil {
+		f.hooks.OnHeadersCompressed(frame.StreamId, n, f.headerBuf.Len())
+	}
 
 	// Set ControlFrameHeader.
 	frame.CFHeader.version = Version
@@ -203,19 +249,13 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 10)
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return err
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
-		return err
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.AssociatedToStreamId); err != nil {
-		return err
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Priority<<5); err != nil {
-		return err
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.Slot); err != nil {
+	b := f.wbuf[:18]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(frame.StreamId))
+	binary.BigEndian.PutUint32(b[12:], uint32(frame.AssociatedToStreamId))
+	b[16] = frame.Priority << 5
+	b[17] = frame.Slot
+	if _, err = f.w.Write(b); err != nil {
 		return err
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -227,19 +267,23 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 
 func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	// Marshal the headers.
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	var n int
+	if n, err = writeHeaderValueBlock(writer, frame.Headers, frame.StreamId); err != nil {
 		return
 	}
 	if !f.headerCompressionDisabled {
 		f.headerCompressor.Flush()
 	}
+	if f.hooks != nil && f.hooks.OnHeadersCompressed != nil {
+		f.hooks.OnHeadersCompressed(frame.StreamId, n, f.headerBuf.Len())
+	}
 
 	// Set ControlFrameHeader.
 	frame.CFHeader.version = Version
@@ -247,10 +291,10 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 4)
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
+	b := f.wbuf[:12]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(frame.StreamId))
+	if _, err = f.w.Write(b); err != nil {
 		return
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -262,19 +306,23 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 
 func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	// Marshal the headers.
 	var writer io.Writer = f.headerBuf
 	if !f.headerCompressionDisabled {
 		writer = f.headerCompressor
 	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	var n int
+	if n, err = writeHeaderValueBlock(writer, frame.Headers, frame.StreamId); err != nil {
 		return
 	}
 	if !f.headerCompressionDisabled {
 		f.headerCompressor.Flush()
 	}
+	if f.hooks != nil && f.hooks.OnHeadersCompressed != nil {
+		f.hooks.OnHeadersCompressed(frame.StreamId, n, f.headerBuf.Len())
+	}
 
 	// Set ControlFrameHeader.
 	frame.CFHeader.version = Version
@@ -282,10 +330,10 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 	frame.CFHeader.length = uint32(len(f.headerBuf.Bytes()) + 4)
 
 	// Serialize frame to Writer.
-	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
-		return
-	}
-	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
+	b := f.wbuf[:12]
+	putControlFrameHeader(b, frame.CFHeader)
+	binary.BigEndian.PutUint32(b[8:], uint32(frame.StreamId))
+	if _, err = f.w.Write(b); err != nil {
 		return
 	}
 	if _, err = f.w.Write(f.headerBuf.Bytes()); err != nil {
@@ -297,18 +345,17 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 
 func (f *Framer) writeDataFrame(frame *DataFrame) (err error) {
 	if frame.StreamId == 0 {
-		return &Error{ZeroStreamId, 0}
+		return &Error{Err: ZeroStreamId, StreamId: 0}
 	}
 	if frame.StreamId&0x80000000 != 0 || len(frame.Data) >= 0x0f000000 {
-		return &Error{InvalidDataFrame, frame.StreamId}
+		return &Error{Err: InvalidDataFrame, StreamId: frame.StreamId}
 	}
 
 	// Serialize frame to Writer.
-	if err = binary.Write(f.w, binary.BigEndian, frame.StreamId); err != nil {
-		return
-	}
-	flagsAndLength := uint32(frame.Flags)<<24 | uint32(len(frame.Data))
-	if err = binary.Write(f.w, binary.BigEndian, flagsAndLength); err != nil {
+	b := f.wbuf[:8]
+	binary.BigEndian.PutUint32(b, uint32(frame.StreamId))
+	binary.BigEndian.PutUint32(b[4:], uint32(frame.Flags)<<24|uint32(len(frame.Data)))
+	if _, err = f.w.Write(b); err != nil {
 		return
 	}
 	if _, err = f.w.Write(frame.Data); err != nil {